@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Thresholds for the detection of mass modifications like ransomware attacks
+const (
+	AnomalyMinFiles      = 5         // Minimum number of modified files before the changes can be considered an attack
+	AnomalyMaxSamples    = 100       // Maximum number of modified files whose content is analyzed
+	AnomalySampleSize    = 64 * 1024 // Number of bytes read from the start of each file
+	AnomalyMinSampleSize = 4 * 1024  // Files smaller than this do not provide a meaningful entropy
+	AnomalyEntropy       = 7.5       // Entropy in bits per byte above which the content looks encrypted
+	AnomalyEntropyJump   = 1.0       // Minimal increase in entropy compared to the last backup
+	AnomalyRatio         = 0.5       // Share of analyzed files that must look encrypted
+	AnomalyRewritten     = 0.9       // Share of changed files whose size and modification time both changed
+	AnomalyRewrittenRef  = 0.5       // Share of the files in the reference that must have been rewritten like this
+)
+
+// detectAnomaly compares the modified files in the source to the ones in the reference. Returns a description of the
+// anomaly or an empty string in case the changes look normal. The reference is read from the storage and its encrypted
+// files are decrypted using the given cipher, as they would always look encrypted.
+func detectAnomaly(storage Storage, plan *Plan, from, ref string, cipher *Cipher) string {
+	anomaly := detectRewrites(plan)
+	if anomaly != "" {
+		return anomaly
+	}
+
+	pairs := modifiedPairs(plan)
+	if len(pairs) < AnomalyMinFiles {
+		return ""
+	}
+
+	// Spread the samples evenly over all modified files
+	step := 1
+	if len(pairs) > AnomalyMaxSamples {
+		step = len(pairs) / AnomalyMaxSamples
+	}
+
+	analyzed := 0
+	encrypted := 0
+	for i := 0; i < len(pairs); i += step {
+		entropyNew, ok := fileEntropy(&LocalStorage{}, filepath.Join(from, pairs[i][0]), nil)
+		if !ok {
+			continue
+		}
+		entropyOld, ok := fileEntropy(storage, filepath.Join(ref, cipher.Path(pairs[i][1])), cipher)
+		if !ok {
+			continue
+		}
+
+		analyzed++
+		if entropyNew >= AnomalyEntropy && entropyNew-entropyOld >= AnomalyEntropyJump {
+			encrypted++
+		}
+	}
+
+	if analyzed < AnomalyMinFiles || float64(encrypted)/float64(analyzed) < AnomalyRatio {
+		return ""
+	}
+
+	return fmt.Sprintf("%d of %d modified files look encrypted, %d modified and %d deleted files in total",
+		encrypted, analyzed, len(plan.Changed), len(plan.Deleted))
+}
+
+// detectRewrites checks whether most files were rewritten at once, which also catches attacks on files that are too
+// small for their entropy to be meaningful. Returns a description of the anomaly or an empty string.
+func detectRewrites(plan *Plan) string {
+	rewritten := 0
+	for _, filePath := range plan.Changed {
+		if plan.rewritten[filePath] {
+			rewritten++
+		}
+	}
+
+	numReference := len(plan.Move) + len(plan.Changed) + len(plan.Deleted) + len(plan.Rename)
+	if rewritten < AnomalyMinFiles || float64(rewritten) < AnomalyRewritten*float64(len(plan.Changed)) ||
+		float64(rewritten) < AnomalyRewrittenRef*float64(numReference) {
+		return ""
+	}
+
+	return fmt.Sprintf("%d of %d changed files have a different size and modification time, %d of %d files in the last "+
+		"backup changed", rewritten, len(plan.Changed), len(plan.Changed), numReference)
+}
+
+// modifiedPairs returns the paths of the modified files in the source and the reference. Besides changed files, new
+// files are included in case they only differ from a deleted one by an additional extension like "photo.jpg.locked".
+func modifiedPairs(plan *Plan) [][2]string {
+	pairs := make([][2]string, 0, len(plan.Changed))
+	for _, filePath := range plan.Changed {
+		pairs = append(pairs, [2]string{filePath, filePath})
+	}
+
+	if len(plan.Deleted) == 0 {
+		return pairs
+	}
+
+	deleted := make(map[string]bool, len(plan.Deleted))
+	for _, filePath := range plan.Deleted {
+		deleted[filePath] = true
+	}
+
+	for _, filePath := range plan.Copy {
+		original := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+		if original != filePath && deleted[original] {
+			pairs = append(pairs, [2]string{filePath, original})
+		}
+	}
+
+	return pairs
+}
+
+// fileEntropy returns the Shannon entropy in bits per byte of the beginning of the given file in the storage. Returns
+// false if the file cannot be read or is too small.
+func fileEntropy(storage Storage, path string, cipher *Cipher) (float64, bool) {
+	file, err := storage.Read(path)
+	if err != nil {
+		Log.F(OutputLevelDebug, "Could not read %s for analysis: %s", path, err.Error())
+		return 0, false
+	}
+	defer LogError(file.Close)
+
+	reader, err := cipher.Reader(file)
+	if err != nil {
+		Log.F(OutputLevelDebug, "Could not decrypt %s for analysis: %s", path, err.Error())
+		return 0, false
+	}
+
+	buffer := make([]byte, AnomalySampleSize)
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		Log.F(OutputLevelDebug, "Could not read %s for analysis: %s", path, err.Error())
+		return 0, false
+	}
+	if n < AnomalyMinSampleSize {
+		return 0, false
+	}
+
+	return entropy(buffer[:n]), true
+}
+
+// entropy calculates the Shannon entropy in bits per byte
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	result := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(data))
+		result -= p * math.Log2(p)
+	}
+
+	return result
+}
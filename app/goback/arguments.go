@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 )
 
 // Arguments contains the values that are set from the command line
@@ -11,7 +12,46 @@ type Arguments struct {
 	OutputLevel int    // What detail to log to stdout
 	Type        string // Backup type - translates to timestamp
 	// ChangeDetection string
-	NoProgress bool // Whether not to output progress information to StdOut
+	NoProgress  bool // Whether not to output progress information to StdOut
+	MaxChange   int  // Maximum percentage of files in the last backup that may be deleted or changed
+	Force       bool // Whether to backup even if the safety checks fail
+	DryRun      bool // Whether to only show what would be done
+	Workers     int  // Number of files copied or moved at the same time
+	HashWorkers int  // Number of directories read at the same time
+	Pipeline    bool // Whether to copy files while the source is still being read
+
+	CompressManifests bool   // Whether to compress the files containing the hashes
+	Durability        string // Which data to flush to disk
+	Traversal         string // Order in which the files are read
+	Verify            bool   // Whether to read copied files back and compare them with the source
+	Dedup             string // Which identical files to hard-link instead of copying them
+
+	Bandwidth      float64 // Maximum MiB/s read from the source and written to the target
+	FilesPerSecond int     // Maximum number of files read or copied per second
+	Nice           bool    // Whether to run with the lowest CPU and I/O priority
+
+	Delta     bool   // Whether to store older versions of large changed files as deltas
+	Restore   string // Name of the backup to restore
+	RestoreTo string // Directory to restore the backup into
+
+	Codec        string // Codec to compress the files in older backups with
+	CompressSkip string // Extensions of files that are not compressed
+	VerifyBackup string // Name of the backup to verify
+
+	Encrypt        bool   // Whether to encrypt a new target
+	EncryptNames   bool   // Whether to encrypt the file names in a new target too
+	PassphraseFile string // File containing the passphrase of an encrypted target
+	KeyFile        string // File containing the key of an encrypted target
+	List           string // Name of the backup to list the files of
+	Diff           string // Name of the backup to compare with the one before
+
+	explicit map[string]bool // Names of the flags given on the command line
+}
+
+// isSet returns true if the flag with the given name was given on the command line, so a false value overwrites the
+// saved configuration
+func (args *Arguments) isSet(name string) bool {
+	return args.explicit[name]
 }
 
 func (args *Arguments) fill() *Exit {
@@ -19,6 +59,32 @@ func (args *Arguments) fill() *Exit {
 	flag.StringVar(&args.Type, "type", "", "How often to create a new incremental backup directory: hourly, daily, monthly, yearly")
 	flag.StringVar(&args.Source, "source", "", "The directory to backup")
 	flag.BoolVar(&args.NoProgress, "no-progress", false, "Whether to suppress progress output to standard output")
+	flag.IntVar(&args.MaxChange, "max-change", 0, fmt.Sprintf("Abort if more than this percentage of the files in the last backup would be deleted or changed (default %d, 100 disables the check)", MaxChangeDefault))
+	flag.BoolVar(&args.DryRun, "dry-run", false, "Only show which files would be moved, copied and left behind without changing anything")
+	flag.IntVar(&args.Workers, "workers", WorkersDefault, "Number of files that are copied or moved at the same time")
+	flag.IntVar(&args.HashWorkers, "hash-workers", WorkersDefault, "Number of directories that are read at the same time when creating hashes")
+	flag.BoolVar(&args.Pipeline, "pipeline", false, "Copy files while the source is still being read instead of reading the whole source first. Skips the checks that need all files")
+	flag.BoolVar(&args.CompressManifests, "compress-manifests", false, "Compress the files containing the hashes using gzip")
+	flag.BoolVar(&args.Verify, "verify", false, "Read every copied file back from the target, compare it with the data read from the source and store its SHA-256 digest in the hashes")
+	flag.StringVar(&args.Dedup, "dedup", "", "Hard-link identical files instead of copying them: none, snapshot (within the new backup) or all (also from older backups) (default none)")
+	flag.BoolVar(&args.Delta, "delta", false, fmt.Sprintf("Store the older version of changed files of at least %s in the last backup as the blocks that differ from the new version", FormatBytes(DeltaMinSize)))
+	flag.StringVar(&args.Codec, "compress-increments", "", "Compress the files left behind in older backups: none, gzip or flate. The latest backup stays uncompressed (default none)")
+	flag.StringVar(&args.CompressSkip, "compress-skip", "", "Comma separated extensions of already compressed files that are not compressed (default "+CompressSkipDefault+")")
+	flag.StringVar(&args.Durability, "durability", "", fmt.Sprintf("Which data to flush to disk: none, metadata (configuration and hashes) or full (additionally all files and renames) (default %s)", DurabilityDefault))
+	flag.StringVar(&args.Traversal, "traversal", "", "Order in which the files are read: name, inode or extent (physical location on disk, Linux only). inode and extent reduce seeking on spinning disks (default name)")
+	flag.Float64Var(&args.Bandwidth, "bandwidth", 0, "Maximum MiB per second read from the source and written to the target, 0 means unlimited")
+	flag.IntVar(&args.FilesPerSecond, "files-per-second", 0, "Maximum number of files read or copied per second, 0 means unlimited")
+	flag.BoolVar(&args.Nice, "nice", false, "Run with the lowest CPU priority and the idle I/O scheduling class (Linux only)")
+	flag.StringVar(&args.Restore, "restore", "", "Restore the backup with the given name or the latest one using \"latest\" instead of creating a backup")
+	flag.StringVar(&args.VerifyBackup, "verify-backup", "", "Verify that all files of the backup with the given name or the latest one using \"latest\" can be restored and are intact")
+	flag.StringVar(&args.List, "list", "", "List the files of the backup with the given name, the latest one using \"latest\" or all backups using \"all\"")
+	flag.StringVar(&args.Diff, "diff", "", "Show the files added, changed, renamed and deleted in the backup with the given name or the latest one using \"latest\" compared to the backup before")
+	flag.StringVar(&args.RestoreTo, "restore-to", "", "The empty directory to restore the backup into")
+	flag.BoolVar(&args.Encrypt, "encrypt", false, "Encrypt the files, hashes and configuration of a new target using AES-256-GCM with a key derived from the passphrase or read from the key file")
+	flag.BoolVar(&args.EncryptNames, "encrypt-names", false, "Encrypt the file names of a new target too, implies -encrypt")
+	flag.StringVar(&args.PassphraseFile, "passphrase-file", "", "File containing the passphrase of an encrypted target (default the environment variable "+PassphraseEnvironment+")")
+	flag.StringVar(&args.KeyFile, "key-file", "", "File containing the 32 byte key of an encrypted target, either binary or hex encoded, instead of a passphrase")
+	flag.BoolVar(&args.Force, "force", false, "Backup even if the source filesystem changed or too many files would be deleted or changed")
 
 	// Not supported yet
 	// flag.StringVar(&args.ChangeDetection, "change", ChangeDetectionModificationAndSize, "Which type of change detection to use: modsize")
@@ -28,6 +94,11 @@ func (args *Arguments) fill() *Exit {
 
 	flag.Parse()
 
+	args.explicit = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		args.explicit[f.Name] = true
+	})
+
 	if !showHelp {
 		arguments := flag.Args()
 
@@ -47,7 +118,8 @@ func (args *Arguments) fill() *Exit {
 		}
 	}
 
-	// Outputlevel and NoProgress are the only arguments that are not stored
+	// Outputlevel, NoProgress, Force, DryRun, Pipeline, the number of workers, the limits and the key are the only
+	// arguments that are not stored
 	Log.Level = args.OutputLevel
 	Log.NoProgress = args.NoProgress
 
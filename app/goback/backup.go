@@ -1,37 +1,81 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
+	"sync"
 	"time"
 )
 
 // Backup is the main goback structure
 type Backup struct {
 	Initial       bool
+	Force         bool
+	Quarantine    bool
+	DryRun        bool
+	Workers       int // Number of files copied or moved at the same time
+	HashWorkers   int // Number of directories read at the same time
+	Pipeline      bool
 	Configuration Configuration
 
 	From string
 	To   string
 	Ref  string
 
-	FromHashes map[string]string
-	RefHashes  map[string]string
+	FromHashes map[string]*ManifestEntry
+	RefHashes  map[string]*ManifestEntry
+	Plan       *Plan       // Comparison of the source with the reference, computed once by the checks
+	Dedup      *DedupIndex // Files with known content if deduplication is enabled
+
+	Statistics Statistics
+	Options    CopyOptions
+	Storage    Storage // Storage of the target, opened from the target given in the arguments if not set
 }
 
 func (backup *Backup) loadConfiguration(args *Arguments) *Exit {
+	location := args.Target
+	if backup.Storage == nil {
+		var exit *Exit
+		backup.Storage, location, exit = OpenStorage(args.Target, args)
+		if exit != nil {
+			return exit
+		}
+	}
+
 	// Initialize backup with Arguments
-	exit, found := backup.Configuration.fill(args)
+	exit, found := backup.Configuration.fill(args, backup.Storage, location)
 	if exit != nil {
 		return exit
 	}
 
 	// The backup folder or no configration file found. Must be an initial backup
 	backup.Initial = !found
+	backup.Force = args.Force
+	backup.DryRun = args.DryRun
+	backup.Workers = args.Workers
+	backup.HashWorkers = args.HashWorkers
+	backup.Pipeline = args.Pipeline
+	if backup.Pipeline && !backup.DryRun {
+		Log.F(OutputLevelWarning, "The pipeline skips the checks for the maximum change, suspicious modifications and free space")
+	}
+	backup.Options = CopyOptions{
+		Statistics: &backup.Statistics,
+		Durability: backup.Configuration.Durability,
+		Throttle:   NewThrottle(args.Bandwidth, args.FilesPerSecond),
+		Verify:     backup.Configuration.Verify,
+		Cipher:     backup.Configuration.cipher,
+
+		Directories: &DirectorySync{},
+	}
+
+	if args.Nice {
+		err := SetLowPriority()
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not lower the priority: %s", err.Error())
+		}
+	}
 
 	exit = backup.setup()
 	if exit != nil {
@@ -51,7 +95,7 @@ func (backup *Backup) setup() *Exit {
 	// Get name of the reference directory
 	if config.LastDirectoryName != "" {
 		backup.Ref = filepath.Join(config.targetDirectory, config.LastDirectoryName)
-		if !DirectoryExists(backup.Ref) {
+		if !storageDirectoryExists(backup.Storage, backup.Ref) {
 			return &Exit{
 				Message: "Reference directory does not exist or cannot be accessed",
 				Code:    ExitcodeNoReference,
@@ -66,18 +110,8 @@ func (backup *Backup) setup() *Exit {
 		}
 	}
 
-	// Create new backup directory
-	err := os.Mkdir(backup.To, os.ModePerm)
-	if err != nil && !os.IsExist(err) {
-		return &Exit{
-			Message: fmt.Sprintf("New backup directory could not be created - %s: %s", backup.To, err.Error()),
-			Code:    ExitcodeNotCreated,
-		}
-	} else if os.IsExist(err) {
-		Log.F(OutputLevelWarning, "Backup directory already exists. Resuming backup into %s", backup.To)
-	}
-
 	// Make sure all paths are normalized
+	var err error
 	if backup.From != "" {
 		backup.From, err = filepath.Abs(backup.From)
 		if err != nil {
@@ -111,28 +145,116 @@ func (backup *Backup) setup() *Exit {
 }
 
 func (backup *Backup) hash() *Exit {
-	// Create hashes for backup data and save new hashes next to backup data
+	// Create hashes for backup data, they are saved next to backup data when the backup is created
 	var exit *Exit
 
-	backup.FromHashes, exit = createHashes(backup.From, backup.To+"."+HashesExtension)
+	backup.FromHashes, exit = createHashes(backup.From, backup.HashWorkers, backup.Configuration.Traversal, backup.Options.Throttle)
 	if exit != nil {
 		return exit
 	}
 
 	if !backup.Initial {
 		// Read hashes for Reference
-		backup.RefHashes, exit = getHashes(backup.Ref)
+		backup.RefHashes, exit = backup.getHashes(backup.Ref)
 		if exit != nil {
 			return exit
 		}
 	} else {
-		backup.RefHashes = make(map[string]string)
+		backup.RefHashes = make(map[string]*ManifestEntry)
+	}
+
+	return nil
+}
+
+// check makes sure the backup looks sane before anything is changed in the target directory
+func (backup *Backup) check() *Exit {
+	plan := backup.plan()
+
+	if !backup.Initial {
+		exit := backup.checkChanges(plan)
+		if exit != nil {
+			return exit
+		}
+	}
+
+	// Make sure the backup fits instead of failing midway. The free space is only known for local targets.
+	if !isLocal(backup.Storage) {
+		return nil
+	}
+	space, err := FreeSpace(backup.Configuration.targetDirectory)
+	if err != nil {
+		Log.F(OutputLevelWarning, "Could not determine free space in %s: %s", backup.Configuration.targetDirectory, err.Error())
+		return nil
+	}
+
+	return checkSpace(plan, space)
+}
+
+// plan compares the source with the last backup and detects files that were renamed in the source. The plan is only
+// computed once.
+func (backup *Backup) plan() *Plan {
+	if backup.Plan != nil {
+		return backup.Plan
+	}
+
+	plan := createPlan(backup.FromHashes, backup.RefHashes)
+	if !backup.Initial {
+		plan.detectRenames(backup.Storage, backup.From, backup.Ref, backup.FromHashes, backup.RefHashes, backup.Options.Cipher, backup.Options.Throttle)
+	}
+	backup.Plan = plan
+
+	return plan
+}
+
+func (backup *Backup) checkChanges(plan *Plan) *Exit {
+	// A ransomware attack would turn the last good backup into an increment
+	if !backup.Force {
+		anomaly := detectAnomaly(backup.Storage, plan, backup.From, backup.Ref, backup.Options.Cipher)
+		if anomaly != "" {
+			Log.F(OutputLevelError, "Suspicious changes in source directory: %s", anomaly)
+			backup.Quarantine = true
+			return nil
+		}
+	}
+
+	// An empty or unmounted source would move everything from the last backup into the old increment
+	ratio := plan.ChangeRatio()
+	maxRatio := float64(backup.Configuration.MaxChange) / 100
+	if ratio > maxRatio {
+		message := fmt.Sprintf("%d of %d files in the last backup would be deleted or changed (%.0f %%, maximum is %d %%)",
+			len(plan.Changed)+len(plan.Deleted), len(backup.RefHashes), ratio*100, backup.Configuration.MaxChange)
+
+		if !backup.Force {
+			return &Exit{
+				Message: message + ". Use -force to backup anyway",
+				Code:    ExitcodeTooManyChanges,
+			}
+		}
+		Log.F(OutputLevelWarning, message)
 	}
 
 	return nil
 }
 
+// dryRun shows what create would do without changing anything
+func (backup *Backup) dryRun() *Exit {
+	Log.F(OutputLevelInfo, "Dry run, nothing is changed in %s", backup.Configuration.targetDirectory)
+
+	plan := backup.plan()
+	plan.Print(os.Stdout)
+
+	return nil
+}
+
 func (backup *Backup) create() *Exit {
+	if backup.Quarantine {
+		return backup.quarantine()
+	}
+
+	exit := backup.createDirectory()
+	if exit != nil {
+		return exit
+	}
 
 	if backup.Initial {
 		Log.F(OutputLevelInfo, "Creating initial copy in %s", backup.To)
@@ -142,50 +264,167 @@ func (backup *Backup) create() *Exit {
 
 	// TODO: Check if new backup directory exists
 
-	// Save last backup reference
-	// TODO: Update Configuration.LastDirectoryName	and save config
-	Log.F(OutputLevelDebug, "Saving backup info in configuration file")
-	backup.Configuration.LastDirectoryName = filepath.Base(backup.To)
-	exit := backup.Configuration.save()
+	// The manifest only replaces its temporary file once all files are in place
+	manifest, exit := CreateManifest(backup.Storage, backup.To+"."+HashesExtension, backup.Configuration.CompressManifests, backup.Configuration.syncMetadata(), backup.Options.Cipher)
 	if exit != nil {
 		return exit
 	}
 
+	backup.prepareDedup()
+
 	// TODO: Go through list of files and compare to reference
 	Log.F(OutputLevelInfo, "Backup of %d files...", len(backup.FromHashes))
+	backup.Statistics.Start()
 	Log.ProgressMax = float64(len(backup.FromHashes))
-	for filePath, hash := range backup.FromHashes {
-		exit := backup.handleFile(filePath, hash)
+	files := orderFiles(backup.From, sortedKeys(backup.FromHashes), backup.FromHashes, backup.Configuration.Traversal)
+	exit = runWorkers(backup.Workers, len(files), func(index int, log *LogBuffer) *Exit {
+		return backup.handleFile(log, files[index], backup.FromHashes[files[index]], backup.RefHashes[files[index]])
+	})
+	if exit == nil {
+		exit = backup.Options.Directories.Sync()
+	}
+	if exit != nil {
+		manifest.Abort()
+		return exit
+	}
+
+	// The hashes are added after copying, as they are updated for files that changed while they were copied
+	for _, filePath := range sortedKeys(backup.FromHashes) {
+		exit = manifest.Add(filePath, backup.FromHashes[filePath])
 		if exit != nil {
+			manifest.Abort()
 			return exit
 		}
 	}
+	exit = manifest.Close()
+	if exit != nil {
+		return exit
+	}
+
+	exit = backup.finish()
+	if exit != nil {
+		return exit
+	}
+
+	backup.Statistics.Log()
+
+	return nil
+}
+
+// finish compresses and cleans up the last backup and saves the configuration, which makes the new backup the last one.
+// The configuration is saved last, so it never refers to a backup that is not complete.
+func (backup *Backup) finish() *Exit {
+	exit := backup.compressIncrement()
+	if exit != nil {
+		return exit
+	}
 
 	// TODO: Remove empty directories
-	exit = CleanDirectory(backup.Ref)
+	exit = CleanDirectory(backup.Storage, backup.Ref)
+	if exit != nil {
+		return exit
+	}
+
+	Log.F(OutputLevelDebug, "Saving backup info in configuration file")
+	backup.Configuration.LastDirectoryName = filepath.Base(backup.To)
+	return backup.Configuration.save()
+}
+
+// quarantine creates a complete copy of the source next to the last backup without changing the last backup. It is
+// used instead of a normal backup when the changes in the source look like an attack.
+func (backup *Backup) quarantine() *Exit {
+	backup.To += QuarantineSuffix
+
+	exit := backup.createDirectory()
+	if exit != nil {
+		return exit
+	}
+
+	Log.F(OutputLevelWarning, "Creating quarantined backup in %s", backup.To)
+	Log.ProgressMax = float64(len(backup.FromHashes))
+	backup.Statistics.Start()
+	files := orderFiles(backup.From, sortedKeys(backup.FromHashes), backup.FromHashes, backup.Configuration.Traversal)
+	exit = runWorkers(backup.Workers, len(files), func(index int, log *LogBuffer) *Exit {
+		return backup.handleQuarantinedFile(log, files[index], backup.FromHashes[files[index]])
+	})
+	if exit == nil {
+		exit = backup.Options.Directories.Sync()
+	}
+	if exit != nil {
+		return exit
+	}
+
+	exit = backup.saveHashes(backup.FromHashes, backup.To+"."+HashesExtension)
 	if exit != nil {
 		return exit
 	}
 
+	backup.Statistics.Log()
+
+	return &Exit{
+		Message: fmt.Sprintf("The changes in the source look suspicious, the backup was quarantined in %s. The last backup %s was not changed. Check the source and use -force to backup anyway", backup.To, backup.Ref),
+		Code:    ExitcodeQuarantine,
+	}
+}
+
+// createDirectory creates the new backup directory
+func (backup *Backup) createDirectory() *Exit {
+	if _, err := backup.Storage.Stat(backup.To); err == nil {
+		Log.F(OutputLevelWarning, "Backup directory already exists. Resuming backup into %s", backup.To)
+		return nil
+	}
+
+	err := backup.Storage.Mkdir(backup.To)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("New backup directory could not be created - %s: %s", backup.To, err.Error()),
+			Code:    ExitcodeNotCreated,
+		}
+	}
+
 	return nil
 }
 
-func (backup *Backup) handleFile(filePath, hash string) *Exit {
-	defer Log.Step()
+func (backup *Backup) handleQuarantinedFile(log *LogBuffer, filePath string, entry *ManifestEntry) *Exit {
+	pathOri := filepath.Join(backup.From, filePath)
+	pathNew := backup.targetPath(backup.To, filePath)
+	pathRef := backup.targetPath(backup.Ref, filePath)
+
+	if _, err := backup.Storage.Stat(pathNew); err == nil {
+		log.F(OutputLevelInfo, "Skipping: %s", pathOri)
+		return nil
+	}
+
+	// Unchanged files are linked, so the last backup stays complete without using additional space
+	linker, canLink := backup.Storage.(storageLinker)
+	if canLink && entry.Unchanged(backup.RefHashes[filePath]) {
+		log.F(OutputLevelInfo, "Linking from last backup: %s", pathOri)
+		if linker.Link(pathRef, pathNew, &backup.Options) == nil {
+			return nil
+		}
+	}
+
+	log.F(OutputLevelInfo, "Copying: %s", pathOri)
+	return backup.copyFile(log, filePath, entry)
+}
 
+func (backup *Backup) handleFile(log *LogBuffer, filePath string, entry, refEntry *ManifestEntry) *Exit {
 	pathOri := filepath.Join(backup.From, filePath)
-	pathNew := filepath.Join(backup.To, filePath)
-	pathRef := filepath.Join(backup.Ref, filePath)
+	pathNew := backup.targetPath(backup.To, filePath)
+	pathRef := backup.targetPath(backup.Ref, filePath)
 
-	_, err := os.Stat(pathNew)
+	backup.Options.Throttle.WaitFile()
+
+	_, err := backup.Storage.Stat(pathNew)
 
 	if err == nil {
 		// If already exists in new backup directory, skip
 		// TODO: Check for reference anyway?
-		Log.F(OutputLevelInfo, "Skipping: %s", pathOri)
+		log.F(OutputLevelInfo, "Skipping: %s", pathOri)
+		backup.Statistics.AddSkip()
 		return nil
 	} else if err != nil && !os.IsNotExist(err) {
-		Log.F(OutputLevelError, "Could not access %s: %s", pathNew, err.Error())
+		log.F(OutputLevelError, "Could not access %s: %s", pathNew, err.Error())
 		return nil
 		// IDEA: OPtion to exit on error?
 		// return &Exit{
@@ -194,21 +433,104 @@ func (backup *Backup) handleFile(filePath, hash string) *Exit {
 		// }
 	}
 
-	if hash == backup.RefHashes[filePath] {
+	if oldPath, digest, renamed := backup.Plan.renamed(filePath); renamed && refEntry == nil {
+		// Renamed in the source, move from the old path in the reference
+		log.F(OutputLevelInfo, "Moving renamed file from last backup: %s (was %s)", pathOri, oldPath)
+		exit := backup.moveFile(backup.targetPath(backup.Ref, oldPath), pathNew)
+		if exit != nil {
+			return exit
+		}
+		entry.RenamedFrom = oldPath
+		entry.Digest = digest
+		backup.Statistics.AddRename(entry.Size)
+		backup.Dedup.Add(entry.Digest, pathNew)
+
+	} else if entry.Unchanged(refEntry) {
 		// If same, move from reference to new backup directory
-		Log.F(OutputLevelInfo, "Moving from last backup: %s", pathOri)
-		exit := MoveFile(pathRef, pathNew)
+		log.F(OutputLevelInfo, "Moving from last backup: %s", pathOri)
+		exit := backup.moveFile(pathRef, pathNew)
 		if exit != nil {
 			return exit
 		}
+		backup.Statistics.AddMove(entry.Size)
+		if entry.Digest == "" {
+			entry.Digest = refEntry.Digest
+		}
+		backup.Dedup.Add(entry.Digest, pathNew)
 
 	} else {
 		// TODO: If differs, copy source to new backup directory
-		Log.F(OutputLevelInfo, "Copying: %s", pathOri)
-		exit := CopyFile(pathOri, pathNew)
+		log.F(OutputLevelInfo, "Copying: %s", pathOri)
+		exit := backup.copyFile(log, filePath, entry)
+		if exit != nil {
+			return exit
+		}
+		if !entry.Inconsistent {
+			backup.Dedup.Add(entry.Digest, pathNew)
+			if refEntry != nil && backup.Configuration.Delta {
+				backup.storeDelta(log, filePath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies a file from the source and makes sure it did not change while it was copied. Changed files are
+// copied again. The entry is updated to describe the content that was copied. If the file keeps changing, it is
+// flagged as inconsistent.
+func (backup *Backup) copyFile(log *LogBuffer, filePath string, entry *ManifestEntry) *Exit {
+	pathOri := filepath.Join(backup.From, filePath)
+	pathNew := backup.targetPath(backup.To, filePath)
+
+	for attempt := 1; attempt <= CopyAttempts; attempt++ {
+		before, err := os.Lstat(pathOri)
+		if err != nil {
+			return &Exit{
+				Message: fmt.Sprintf("Reading %s: %s", pathOri, err.Error()),
+				Code:    ExitcodeCopyRead,
+			}
+		}
+
+		options, stored := backup.copyOptions(log, pathOri)
+		digest, exit := storeFile(backup.Storage, pathOri, pathNew, options)
+		stored()
 		if exit != nil {
 			return exit
 		}
+
+		copied := NewManifestEntry(before)
+		copied.Digest = digest
+		after, err := os.Lstat(pathOri)
+		if err == nil {
+			current := NewManifestEntry(after)
+			if current.Unchanged(copied) && current.Inode == copied.Inode {
+				*entry = *copied
+				return nil
+			}
+		}
+
+		log.F(OutputLevelWarning, "%s changed while it was copied (attempt %d of %d)", pathOri, attempt, CopyAttempts)
+		if err != nil {
+			// Deleted while it was copied, there is nothing to retry
+			break
+		}
+	}
+
+	entry.Inconsistent = true
+	backup.Statistics.AddInconsistent(filePath)
+
+	return nil
+}
+
+// moveFile moves a file from the reference into the new backup
+func (backup *Backup) moveFile(source, destination string) *Exit {
+	err := backup.Storage.Move(source, destination, &backup.Options)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("Moving %s: %s", source, err.Error()),
+			Code:    ExitcodeCopyCreateDir,
+		}
 	}
 
 	return nil
@@ -220,38 +542,118 @@ func (backup *Backup) handleFile(filePath, hash string) *Exit {
 ///
 ///
 
-func createHashes(directory, file string) (map[string]string, *Exit) {
-	hashes := map[string]string{}
+func createHashes(directory string, workers int, traversal string, throttle *Throttle) (map[string]*ManifestEntry, *Exit) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	hasher := &directoryHasher{
+		hashes:    map[string]*ManifestEntry{},
+		errors:    map[string]*Exit{},
+		traversal: traversal,
+		throttle:  throttle,
+	}
+	hasher.ready = sync.NewCond(&hasher.mutex)
 
 	Log.ProgressMessage(fmt.Sprintf("Creating hashes for directory %s...", directory))
 
-	exit := hashDirectory(directory, "", hashes)
+	exit := hasher.hashDirectory(directory, "")
 	if exit != nil {
 		return nil, exit
 	}
 
-	hashData, err := json.Marshal(hashes)
-	if err != nil {
-		return nil, &Exit{
-			Message: fmt.Sprintf("ERROR: Could not save hashes: %s", err.Error()),
-			Code:    ExitcodeHashesMarshal,
-		}
+	var wait sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			hasher.work()
+		}()
 	}
+	wait.Wait()
 
-	Log.F(OutputLevelDebug, "Saving hashes for %s in %s", directory, file)
-	err = ioutil.WriteFile(file, hashData, os.ModePerm)
-	if err != nil {
-		return nil, &Exit{
-			Message: fmt.Sprintf("ERROR: Could not save hashes in %s: %s", file, err.Error()),
-			Code:    ExitcodeHashesWrite,
+	// Reported after reading, as the workers read the directories in varying order
+	for _, dir := range sortedExits(hasher.errors) {
+		Log.F(OutputLevelError, hasher.errors[dir].Message)
+	}
+
+	return hasher.hashes, nil
+}
+
+// targetPath returns the path of a file in a backup directory. It differs from the path in the source if the file names
+// are encrypted.
+func (backup *Backup) targetPath(dir, filePath string) string {
+	return filepath.Join(dir, backup.Options.Cipher.Path(filePath))
+}
+
+// saveHashes writes the hashes into a manifest file
+func (backup *Backup) saveHashes(hashes map[string]*ManifestEntry, file string) *Exit {
+	manifest, exit := CreateManifest(backup.Storage, file, backup.Configuration.CompressManifests, backup.Configuration.syncMetadata(), backup.Options.Cipher)
+	if exit != nil {
+		return exit
+	}
+
+	for _, filePath := range sortedKeys(hashes) {
+		exit = manifest.Add(filePath, hashes[filePath])
+		if exit != nil {
+			return exit
 		}
 	}
 
-	return hashes, nil
+	return manifest.Close()
 }
 
-func hashDirectory(dir, prefix string, hashes map[string]string) *Exit {
-	files, err := ioutil.ReadDir(dir)
+// directoryHasher creates the hashes for a directory tree, reading several directories at the same time
+type directoryHasher struct {
+	hashes    map[string]*ManifestEntry
+	errors    map[string]*Exit // Subdirectories that could not be read
+	mutex     sync.Mutex
+	ready     *sync.Cond     // Signalled when a directory is queued or the last one was read
+	queue     []hashedFolder // Directories waiting to be read
+	pending   int            // Directories queued or being read
+	traversal string
+	throttle  *Throttle
+}
+
+// hashedFolder is a directory queued for reading and the prefix of its files in the hashes
+type hashedFolder struct {
+	dir    string
+	prefix string
+}
+
+// work reads the queued directories until all directories of the tree have been read
+func (hasher *directoryHasher) work() {
+	hasher.mutex.Lock()
+	defer hasher.mutex.Unlock()
+
+	for {
+		for len(hasher.queue) == 0 && hasher.pending > 0 {
+			hasher.ready.Wait()
+		}
+		if hasher.pending == 0 {
+			return
+		}
+
+		folder := hasher.queue[len(hasher.queue)-1]
+		hasher.queue = hasher.queue[:len(hasher.queue)-1]
+
+		hasher.mutex.Unlock()
+		exit := hasher.hashDirectory(folder.dir, folder.prefix)
+		hasher.mutex.Lock()
+		if exit != nil {
+			hasher.errors[folder.dir] = exit
+		}
+
+		hasher.pending--
+		if hasher.pending == 0 {
+			hasher.ready.Broadcast()
+		}
+	}
+}
+
+// hashDirectory adds the files of the directory to the hashes and queues its subdirectories
+func (hasher *directoryHasher) hashDirectory(dir, prefix string) *Exit {
+	files, err := readDirectory(dir, hasher.traversal)
 	if err != nil {
 		return &Exit{
 			Message: fmt.Sprintf("ERROR: Could not read directory %s: %s", dir, err.Error()),
@@ -262,40 +664,78 @@ func hashDirectory(dir, prefix string, hashes map[string]string) *Exit {
 	for _, file := range files {
 		name := file.Name()
 		if file.IsDir() {
-			hashDirectory(filepath.Join(dir, name), prefix+name+"/", hashes)
+			hasher.mutex.Lock()
+			hasher.queue = append(hasher.queue, hashedFolder{filepath.Join(dir, name), prefix + name + "/"})
+			hasher.pending++
+			hasher.mutex.Unlock()
+			hasher.ready.Signal()
 		} else {
-			// TODO: Actually calculate hash
-			// ChangeDetectionModificationAndSize
+			hasher.throttle.WaitFile()
+			entry := NewManifestEntry(file)
 
-			hashes[prefix+name] = file.ModTime().Format(TimestampFormatHash) + "|" + strconv.FormatInt(file.Size(), 10)
+			hasher.mutex.Lock()
+			hasher.hashes[prefix+name] = entry
+			hasher.mutex.Unlock()
 		}
 	}
 
 	return nil
 }
 
-func getHashes(dir string) (map[string]string, *Exit) {
-	hashes := make(map[string]string)
-	hashesFound := false
+// sortedKeys returns the paths of the given hashes in sorted order
+func sortedKeys(hashes map[string]*ManifestEntry) []string {
+	keys := make([]string, 0, len(hashes))
+	for key := range hashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// sortedExits returns the directories of the given errors in sorted order
+func sortedExits(exits map[string]*Exit) []string {
+	dirs := make([]string, 0, len(exits))
+	for dir := range exits {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs
+}
+
+// getHashes reads the hashes for the given backup directory from its manifest. If the manifest cannot be read, the
+// hashes are created from the directory and saved unless this is a dry run.
+func (backup *Backup) getHashes(dir string) (map[string]*ManifestEntry, *Exit) {
 	hashFile := dir + "." + HashesExtension
 
 	Log.F(OutputLevelDebug, "Reading hashes from %s", hashFile)
-	hashData, err := ioutil.ReadFile(hashFile)
+	hashes, found, err := ReadManifest(backup.Storage, hashFile, backup.Options.Cipher)
 	if err != nil {
-		Log.F(OutputLevelWarning, "Could not read hashes for %s: %s", hashFile, err.Error())
+		Log.F(OutputLevelWarning, "Could not read hashes from %s: %s", hashFile, err.Error())
+	} else if !found {
+		Log.F(OutputLevelWarning, "Could not read hashes for %s: File does not exist", hashFile)
 	} else {
-		err = json.Unmarshal(hashData, &hashes)
-		if err != nil {
-			Log.F(OutputLevelWarning, "Could not read hashes from %s: %s", hashFile, err.Error())
-		} else {
-			hashesFound = true
+		return hashes, nil
+	}
+
+	// The sizes and names of encrypted files differ from the ones in the source and only local directories can be read
+	// like the source
+	if backup.Options.Cipher != nil || !isLocal(backup.Storage) {
+		return nil, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not read hashes for %s, they can only be created again for an unencrypted local backup", dir),
+			Code:    ExitcodeNoReference,
 		}
 	}
 
 	// If no hashes for reference cannot be found, create them
-	if !hashesFound {
-		var exit *Exit
-		hashes, exit = createHashes(dir, hashFile)
+	hashes, exit := createHashes(dir, backup.HashWorkers, backup.Configuration.Traversal, backup.Options.Throttle)
+	if exit != nil {
+		return nil, exit
+	}
+
+	if !backup.DryRun {
+		exit = backup.saveHashes(hashes, hashFile)
 		if exit != nil {
 			return nil, exit
 		}
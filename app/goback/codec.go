@@ -0,0 +1,193 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Codecs for compressing files in older backups
+const (
+	CodecNone  = "none"
+	CodecGzip  = "gzip"
+	CodecFlate = "flate"
+)
+
+// CompressSkipDefault are the extensions of files that are already compressed and not compressed again
+const CompressSkipDefault = ".7z,.avi,.bz2,.docx,.flac,.gif,.gz,.heic,.jpeg,.jpg,.mkv,.mov,.mp3,.mp4,.ogg,.pdf,.png,.rar,.webm,.webp,.xlsx,.xz,.zip,.zst"
+
+// Codec compresses files in older backups. Compressed files are stored with the extension of the codec appended.
+type Codec struct {
+	Extension string
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Codecs contains the codecs by their name as recorded in the hashes. Other codecs can be registered here.
+var Codecs = map[string]*Codec{
+	CodecGzip: {
+		Extension: ".gz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	CodecFlate: {
+		Extension: ".deflate",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+}
+
+// codecNames returns the names of the registered codecs in sorted order
+func codecNames() []string {
+	names := make([]string, 0, len(Codecs))
+	for name := range Codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressFile writes the compressed content of the file in the storage to the path with the extension of the codec
+// appended. The file itself is kept, so it can be removed once the compression is recorded. Encrypted files are
+// decrypted before and encrypted again after compressing them.
+func compressFile(storage Storage, filePath string, codec *Codec, sync bool, cipher *Cipher) error {
+	in, err := storage.Read(filePath)
+	if err != nil {
+		return err
+	}
+	defer LogError(in.Close)
+
+	reader, err := cipher.Reader(in)
+	if err != nil {
+		return err
+	}
+
+	out, err := storage.Put(filePath + codec.Extension)
+	if err != nil {
+		return err
+	}
+
+	encrypter, err := cipher.Writer(out)
+	if err == nil {
+		var writer io.WriteCloser
+		writer, err = codec.NewWriter(encrypter)
+		if err == nil {
+			_, err = io.Copy(writer, reader)
+			if closeErr := writer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if closeErr := encrypter.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		out.Abort()
+		return err
+	}
+
+	return out.Commit(sync)
+}
+
+// skipCompression returns true if the file is already compressed according to its extension
+func (config *Configuration) skipCompression(filePath string) bool {
+	extension := strings.ToLower(path.Ext(filePath))
+	if extension == "" {
+		return false
+	}
+
+	skip := config.CompressSkip
+	if skip == "" {
+		skip = CompressSkipDefault
+	}
+	for _, skipped := range strings.Split(skip, ",") {
+		if strings.TrimSpace(strings.ToLower(skipped)) == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressIncrement compresses the files left behind in the last backup, which is now an increment, and records the
+// codec in its hashes. The uncompressed files are only removed once the hashes are saved, so every file can be found
+// if the backup is interrupted. The new backup stays uncompressed.
+func (backup *Backup) compressIncrement() *Exit {
+	codec := Codecs[backup.Configuration.Codec]
+	if codec == nil || backup.Ref == "" {
+		return nil
+	}
+
+	hashFile := backup.Ref + "." + HashesExtension
+	hashes := backup.RefHashes
+	if hashes == nil {
+		var err error
+		hashes, _, err = ReadManifest(backup.Storage, hashFile, backup.Options.Cipher)
+		if err != nil || hashes == nil {
+			Log.F(OutputLevelWarning, "Could not read hashes of %s, it is not compressed", backup.Ref)
+			return nil
+		}
+	}
+
+	compressed := []string{}
+	for _, filePath := range sortedKeys(hashes) {
+		entry := hashes[filePath]
+		if entry.Codec != "" || entry.Type == EntryTypeOther || backup.Configuration.skipCompression(filePath) {
+			continue
+		}
+
+		pathRef := backup.targetPath(backup.Ref, filePath)
+		info, err := backup.Storage.Stat(pathRef)
+		if err != nil || !info.Mode().IsRegular() {
+			// Moved into the new backup or stored as delta
+			continue
+		}
+
+		// The compressed file must not replace another file
+		if _, found := hashes[filePath+codec.Extension]; found {
+			Log.F(OutputLevelDebug, "Not compressing %s, %s exists", pathRef, filePath+codec.Extension)
+			continue
+		}
+		if _, err := backup.Storage.Stat(pathRef + codec.Extension); err == nil {
+			Log.F(OutputLevelDebug, "Not compressing %s, %s exists", pathRef, pathRef+codec.Extension)
+			continue
+		}
+
+		err = compressFile(backup.Storage, pathRef, codec, backup.Options.syncFiles(), backup.Options.Cipher)
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not compress %s: %s", pathRef, err.Error())
+			continue
+		}
+		entry.Codec = backup.Configuration.Codec
+		compressed = append(compressed, pathRef)
+	}
+
+	if len(compressed) == 0 {
+		return nil
+	}
+
+	exit := backup.saveHashes(hashes, hashFile)
+	if exit != nil {
+		for _, pathRef := range compressed {
+			_ = backup.Storage.Delete(pathRef + codec.Extension)
+		}
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: Could not record the compression in the hashes of %s: %s", backup.Ref, exit.Message),
+			Code:    exit.Code,
+		}
+	}
+
+	for _, pathRef := range compressed {
+		err := backup.Storage.Delete(pathRef)
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not remove %s after compressing it: %s", pathRef, err.Error())
+		}
+	}
+	Log.F(OutputLevelInfo, "Compressed %d files in %s", len(compressed), backup.Ref)
+
+	return nil
+}
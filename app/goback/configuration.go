@@ -1,23 +1,46 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 )
 
 // Configuration contains everything that can be saved per backup
 type Configuration struct {
-	ChangeDetection   string `json:"change"`
-	LastDirectoryName string `json:"last"`
-	SourceDirectory   string `json:"source"`
-	Format            string `json:"format"`
+	ChangeDetection   string                `json:"change"`
+	LastDirectoryName string                `json:"last"`
+	SourceDirectory   string                `json:"source"`
+	Format            string                `json:"format"`
+	SourceIdentity    string                `json:"sourceid,omitempty"`
+	MaxChange         int                   `json:"maxchange,omitempty"`
+	CompressManifests bool                  `json:"compressmanifests,omitempty"`
+	Durability        string                `json:"durability,omitempty"`
+	Traversal         string                `json:"traversal,omitempty"`
+	Verify            bool                  `json:"verify,omitempty"`
+	Dedup             string                `json:"dedup,omitempty"`
+	Delta             bool                  `json:"delta,omitempty"`
+	Codec             string                `json:"codec,omitempty"`
+	CompressSkip      string                `json:"compressskip,omitempty"`
+	Encryption        *EncryptionParameters `json:"-"`
 	targetDirectory   string
+	storage           Storage // Storage of the target
+	cipher            *Cipher // Encrypts the data in the target if encryption is enabled
 }
 
-func (config *Configuration) fill(args *Arguments) (*Exit, bool) {
+// sealedConfiguration is written instead of the configuration if the target is encrypted. Only the parameters needed
+// to derive the key are readable.
+type sealedConfiguration struct {
+	Encryption *EncryptionParameters `json:"encryption"`
+	Sealed     string                `json:"sealed"` // Encrypted configuration in base64 encoding
+}
+
+func (config *Configuration) fill(args *Arguments, storage Storage, location string) (*Exit, bool) {
 
 	// First try to load configuration from target
-	exit, found := config.load(args.Target)
+	exit, found := config.load(storage, location, args)
 	if exit != nil {
 		return exit, found
 	}
@@ -31,9 +54,18 @@ func (config *Configuration) fill(args *Arguments) (*Exit, bool) {
 	return nil, found
 }
 
-// load reads the configuration from metadata file
-func (config *Configuration) load(targetDirectory string) (*Exit, bool) {
-	found, err := ReadJSON(filepath.Join(targetDirectory, ConfigurationFile), &config)
+// load reads the configuration from metadata file in the target at the given location of the storage. The
+// configuration of an encrypted target is decrypted using the key given in the arguments.
+func (config *Configuration) load(storage Storage, targetDirectory string, args *Arguments) (*Exit, bool) {
+	config.storage = storage
+
+	sealed := sealedConfiguration{}
+	found, err := ReadJSON(storage, filepath.Join(targetDirectory, ConfigurationFile), &sealed)
+	if err == nil && found && sealed.Encryption != nil {
+		err = config.unseal(&sealed, args)
+	} else if err == nil && found {
+		_, err = ReadJSON(storage, filepath.Join(targetDirectory, ConfigurationFile), &config)
+	}
 	if err != nil {
 		return &Exit{
 			Code:    ExitCodeConfigurationRead,
@@ -50,8 +82,51 @@ func (config *Configuration) load(targetDirectory string) (*Exit, bool) {
 	return nil, true
 }
 
+// unseal derives the key and decrypts the configuration of an encrypted target
+func (config *Configuration) unseal(sealed *sealedConfiguration, args *Arguments) error {
+	cipher, err := sealed.Encryption.Cipher(args)
+	if err != nil {
+		return err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed.Sealed)
+	if err == nil {
+		data, err = cipher.Open(data)
+	}
+	if err != nil {
+		return fmt.Errorf("the key is wrong or the configuration is corrupt")
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return err
+	}
+	config.cipher = cipher
+	config.Encryption = sealed.Encryption
+
+	return nil
+}
+
 func (config *Configuration) save() *Exit {
-	err := WriteJSON(filepath.Join(config.targetDirectory, ConfigurationFile), config)
+	var structure interface{} = config
+	if config.cipher != nil {
+		data, err := json.Marshal(config)
+		if err == nil {
+			data, err = config.cipher.Seal(data)
+		}
+		if err != nil {
+			return &Exit{
+				Code:    ExitCodeConfigurationWrite,
+				Message: "Could not encrypt configuration: " + err.Error(),
+			}
+		}
+		structure = sealedConfiguration{
+			Encryption: config.Encryption,
+			Sealed:     base64.StdEncoding.EncodeToString(data),
+		}
+	}
+
+	err := WriteJSON(config.storage, filepath.Join(config.targetDirectory, ConfigurationFile), structure, config.syncMetadata())
 	if err != nil {
 		return &Exit{
 			Code:    ExitCodeConfigurationWrite,
@@ -77,13 +152,13 @@ func (config *Configuration) set(args *Arguments) *Exit {
 		showHelp = true
 		Log.F(OutputLevelError, "Please provide target directory as unnamed argument")
 	} else {
-		config.targetDirectory, err = filepath.Abs(args.Target)
-		if err != nil {
-			showHelp = true
-			Log.F(OutputLevelError, "Target directory is not valid")
+		var target os.FileInfo
+		if isLocal(config.storage) {
+			// The target directory may be reached through a symlink
+			target, err = os.Stat(config.targetDirectory)
+		} else {
+			target, err = config.storage.Stat(config.targetDirectory)
 		}
-
-		target, err := os.Stat(config.targetDirectory)
 		if err != nil {
 			showHelp = true
 			Log.F(OutputLevelError, "Cannot access target directory %s: %s", config.targetDirectory, err.Error())
@@ -96,6 +171,7 @@ func (config *Configuration) set(args *Arguments) *Exit {
 
 	// Check if source exists
 	// Check if source is a directory
+	previousSource := config.SourceDirectory
 	if args.Source != "" {
 		config.SourceDirectory, err = filepath.Abs(args.Source)
 		if err != nil {
@@ -113,6 +189,128 @@ func (config *Configuration) set(args *Arguments) *Exit {
 		Log.F(OutputLevelError, "Source is not a directory")
 	}
 
+	// Make sure the source is still on the same filesystem, otherwise an unmounted disk would lead to an empty backup
+	if !showHelp {
+		exit := config.checkSourceIdentity(config.SourceDirectory != previousSource, args.Force)
+		if exit != nil {
+			return exit
+		}
+	}
+
+	if args.MaxChange != 0 {
+		if args.MaxChange < 1 || args.MaxChange > 100 {
+			showHelp = true
+			Log.F(OutputLevelError, "The maximum change must be a percentage between 1 and 100")
+		} else {
+			config.MaxChange = args.MaxChange
+		}
+	}
+	if config.MaxChange == 0 {
+		config.MaxChange = MaxChangeDefault
+	}
+
+	if args.CompressManifests || args.isSet("compress-manifests") {
+		config.CompressManifests = args.CompressManifests
+	}
+
+	if args.Verify || args.isSet("verify") {
+		config.Verify = args.Verify
+	}
+
+	if args.Delta || args.isSet("delta") {
+		config.Delta = args.Delta
+	}
+
+	if args.Codec != "" {
+		if _, found := Codecs[args.Codec]; found || args.Codec == CodecNone {
+			config.Codec = args.Codec
+		} else {
+			showHelp = true
+			Log.F(OutputLevelError, "Invalid codec %s", args.Codec)
+		}
+	}
+	if config.Codec == "" {
+		config.Codec = CodecNone
+	}
+
+	if args.CompressSkip != "" {
+		config.CompressSkip = args.CompressSkip
+	}
+
+	if args.Durability != "" {
+		switch args.Durability {
+		case DurabilityNone, DurabilityMetadata, DurabilityFull:
+			config.Durability = args.Durability
+		default:
+			showHelp = true
+			Log.F(OutputLevelError, "Invalid durability level %s", args.Durability)
+		}
+	}
+	if config.Durability == "" {
+		config.Durability = DurabilityDefault
+	}
+	if _, sftp := config.storage.(*SFTPStorage); sftp && config.Durability != DurabilityNone {
+		Log.F(OutputLevelWarning, "Files cannot be flushed to disk using SFTP, the durability level %s is not guaranteed", config.Durability)
+	}
+
+	if args.Traversal != "" {
+		switch args.Traversal {
+		case TraversalName, TraversalInode, TraversalExtent:
+			config.Traversal = args.Traversal
+		default:
+			showHelp = true
+			Log.F(OutputLevelError, "Invalid traversal order %s", args.Traversal)
+		}
+	}
+	if config.Traversal == "" {
+		config.Traversal = TraversalName
+	}
+
+	if args.Dedup != "" {
+		switch args.Dedup {
+		case DedupNone, DedupSnapshot, DedupAll:
+			config.Dedup = args.Dedup
+		default:
+			showHelp = true
+			Log.F(OutputLevelError, "Invalid deduplication mode %s", args.Dedup)
+		}
+	}
+	if config.Dedup == "" {
+		config.Dedup = DedupNone
+	}
+	if _, linker := config.storage.(storageLinker); config.Dedup != DedupNone && !linker {
+		showHelp = true
+		Log.F(OutputLevelError, "Deduplication needs a target that supports hard links")
+	}
+
+	if args.Encrypt || args.EncryptNames {
+		if config.cipher == nil && config.LastDirectoryName != "" {
+			showHelp = true
+			Log.F(OutputLevelError, "Encryption can only be enabled on the first backup into a target")
+		} else if config.cipher == nil {
+			exit := config.enableEncryption(args)
+			if exit != nil {
+				return exit
+			}
+		}
+	}
+
+	// Backing up into the source would include all previous backups in every new one
+	if !showHelp && isLocal(config.storage) {
+		inside, err := IsInsideDirectory(config.targetDirectory, config.SourceDirectory)
+		if err != nil {
+			return &Exit{
+				Code:    ExitCodeConfiguration,
+				Message: fmt.Sprintf("Could not compare source and target directory: %s", err.Error()),
+			}
+		} else if inside {
+			return &Exit{
+				Code:    ExitcodeTargetInSource,
+				Message: fmt.Sprintf("Target directory %s is inside the source directory %s. Please choose a target outside of the source", config.targetDirectory, config.SourceDirectory),
+			}
+		}
+	}
+
 	// Not supported yet:
 
 	// switch args.ChangeDetection {
@@ -152,3 +350,52 @@ func (config *Configuration) set(args *Arguments) *Exit {
 	return nil
 
 }
+
+// checkSourceIdentity compares the filesystem of the source directory to the one recorded on the last backup. The
+// identity is recorded again if the source directory changed or the check is forced.
+func (config *Configuration) checkSourceIdentity(sourceChanged, force bool) *Exit {
+	identity, err := SourceIdentity(config.SourceDirectory)
+	if err != nil {
+		return &Exit{
+			Code:    ExitCodeConfiguration,
+			Message: fmt.Sprintf("Could not identify source filesystem of %s: %s", config.SourceDirectory, err.Error()),
+		}
+	}
+
+	if config.SourceIdentity != "" && config.SourceIdentity != identity && !sourceChanged {
+		if !force {
+			return &Exit{
+				Code:    ExitcodeSourceChanged,
+				Message: fmt.Sprintf("Source directory %s is not on the same filesystem as on the last backup. Make sure it is mounted or use -force to backup anyway", config.SourceDirectory),
+			}
+		}
+		Log.F(OutputLevelWarning, "Source directory %s is not on the same filesystem as on the last backup", config.SourceDirectory)
+	}
+
+	config.SourceIdentity = identity
+
+	return nil
+}
+
+// enableEncryption creates the parameters for deriving the key of a new encrypted target from the passphrase or the key
+// file given in the arguments
+func (config *Configuration) enableEncryption(args *Arguments) *Exit {
+	params, err := NewEncryptionParameters(args.KeyFile != "", args.EncryptNames)
+	if err == nil {
+		config.cipher, err = params.Cipher(args)
+	}
+	if err != nil {
+		return &Exit{
+			Code:    ExitCodeConfiguration,
+			Message: "Could not enable encryption: " + err.Error(),
+		}
+	}
+	config.Encryption = params
+
+	return nil
+}
+
+// syncMetadata returns true if the configuration and the files containing the hashes have to be flushed to disk
+func (config *Configuration) syncMetadata() bool {
+	return config.Durability != DurabilityNone
+}
@@ -10,7 +10,7 @@ const (
 	// TimestampFormatSecond = "2006-01-02-15-04-05"
 	TimestampFormatTest = "2006-01-02-15-04-05.999" // For testing so we can create new backups in short time
 
-	// TimestampFormatHash is used for change detection when using "modsize"
+	// TimestampFormatHash was used for change detection in manifests written by older versions
 	TimestampFormatHash = "20060102150405"
 )
 
@@ -29,6 +29,26 @@ const (
 	ChangeDetectionModificationAndSize = "modsize"
 )
 
+// QuarantineSuffix is appended to the name of a backup directory that was created from suspicious changes
+const QuarantineSuffix = ".quarantine"
+
+// MaxChangeDefault is the percentage of files in the last backup that may be deleted or changed before a backup is
+// aborted unless it is forced
+const MaxChangeDefault = 30
+
+// CopyAttempts is how often a file that changes while it is copied is copied again before it is flagged as inconsistent
+const CopyAttempts = 3
+
+// Durability levels describing which data is flushed to disk
+const (
+	DurabilityNone     = "none"     // Nothing is flushed, the operating system decides when data is written
+	DurabilityMetadata = "metadata" // The configuration and the files containing the hashes are flushed
+	DurabilityFull     = "full"     // Additionally every copied file and every rename is flushed
+)
+
+// DurabilityDefault is the durability level used unless configured otherwise
+const DurabilityDefault = DurabilityFull
+
 // ConfigurationFile is the name of the main metadata file in the backup directory
 const ConfigurationFile = "config.goback"
 
@@ -56,6 +76,15 @@ const (
 	ExitCodeConfigurationRead  = 16
 	ExitCodeConfigurationWrite = 17
 	ExitcodeCleanup            = 18
+	ExitcodeTargetInSource     = 19
+	ExitcodeSourceChanged      = 20
+	ExitcodeTooManyChanges     = 21
+	ExitcodeQuarantine         = 22
+	ExitcodeNoSpace            = 23
+	ExitcodeCopyVerify         = 24
+	ExitcodeSync               = 25
+	ExitcodeRestore            = 26
+	ExitcodeVerify             = 27
 
 	ExitcodeOutput = 99
 )
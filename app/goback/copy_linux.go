@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyData copies the content of in to out using the fastest method available within the limits of the throttle and
+// returns the method used
+func copyData(out, in *os.File, size int64, throttle *Throttle) (string, error) {
+	// Reflinks share the data blocks on copy-on-write filesystems like btrfs and XFS. As no data is copied, they are not
+	// throttled.
+	err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if err == nil {
+		return CopyMethodReflink, nil
+	}
+
+	// Allocating the whole file at once avoids fragmentation. Not all filesystems support it, which is fine.
+	if size > 0 {
+		_ = unix.Fallocate(int(out.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	}
+
+	// copy_file_range copies inside the kernel and can use server side copies on network filesystems
+	chunkSize := 1 << 30
+	if throttle.LimitsBandwidth() {
+		chunkSize = throttleChunkSize
+	}
+	copied := int64(0)
+	for {
+		n, err := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, chunkSize, 0)
+		copied += int64(n)
+		throttle.WaitBytes(int64(n))
+		if err != nil {
+			if copied == 0 && isCopyFileRangeUnsupported(err) {
+				break
+			}
+			return CopyMethodCopyFileRange, err
+		}
+		if n == 0 {
+			return CopyMethodCopyFileRange, nil
+		}
+	}
+
+	_, err = io.Copy(out, throttle.Reader(in))
+	return CopyMethodCopy, err
+}
+
+// dropCache removes the data of the given file from the page cache, so it is read from disk the next time. The data must
+// have been flushed to disk before.
+func dropCache(file *os.File) {
+	_ = unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// isCopyFileRangeUnsupported returns true if copy_file_range cannot be used for the files
+func isCopyFileRangeUnsupported(err error) bool {
+	switch err {
+	case unix.ENOSYS, unix.EXDEV, unix.EINVAL, unix.EOPNOTSUPP, unix.EPERM, unix.EBADF:
+		return true
+	}
+	return false
+}
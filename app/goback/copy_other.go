@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// copyData copies the content of in to out within the limits of the throttle and returns the method used
+func copyData(out, in *os.File, size int64, throttle *Throttle) (string, error) {
+	_, err := io.Copy(out, throttle.Reader(in))
+	return CopyMethodCopy, err
+}
+
+// dropCache is not supported on this platform, the data is read back from the cache if it is still there
+func dropCache(file *os.File) {}
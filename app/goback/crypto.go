@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation functions for the key of an encrypted target
+const (
+	KDFPBKDF2  = "pbkdf2-sha256" // The key is derived from a passphrase
+	KDFKeyFile = "keyfile"       // The key is read from a file
+)
+
+// KDFIterationsDefault is the number of PBKDF2 iterations used for new targets
+const KDFIterationsDefault = 200000
+
+// PassphraseEnvironment is the environment variable the passphrase is read from if no passphrase file is given
+const PassphraseEnvironment = "GOBACK_PASSPHRASE"
+
+// encryptionChunkSize is the amount of plain data sealed at once. Every chunk is authenticated on its own, so large
+// files can be decrypted while they are read.
+const encryptionChunkSize = 64 * 1024
+
+// encryptionMagic starts every encrypted file, the last byte is the version of the format. It is followed by a random
+// salt, a random nonce prefix and the sealed chunks. Every file is sealed using its own key derived from the content key
+// and the salt, so the nonces of different files cannot collide. The nonce of a chunk consists of the prefix, the number
+// of the chunk and a flag marking the last chunk, so chunks cannot be reordered and files cannot be truncated unnoticed.
+var encryptionMagic = []byte("GOBACKENC\x01")
+
+const (
+	encryptionSaltSize = 32
+	noncePrefixSize    = 7
+	encryptionOverhead = 16 // Size of the GCM tag of every chunk
+)
+
+// encryptionHeaderSize is the size of the magic, the salt and the nonce prefix at the start of every encrypted file
+var encryptionHeaderSize = len(encryptionMagic) + encryptionSaltSize + noncePrefixSize
+
+// encryptedNameMax is the length of the longest encrypted name stored as it is. It leaves room for the extensions
+// appended to the names of files on the target within the 255 bytes most filesystems allow.
+const encryptedNameMax = 200
+
+// encryptedNameHashed starts the names that are too long to be stored encrypted. They are replaced by their keyed hash.
+const encryptedNameHashed = "~"
+
+// EncryptionParameters describe how the key of an encrypted target is derived. They are stored unencrypted in the
+// configuration file.
+type EncryptionParameters struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       string `json:"salt,omitempty"`
+	Names      bool   `json:"names,omitempty"` // Whether the file names are encrypted too
+}
+
+// Cipher encrypts the data written to an encrypted target using AES-256-GCM. A nil Cipher leaves everything
+// unencrypted.
+type Cipher struct {
+	key     []byte // Content key the keys of the files are derived from
+	names   bool
+	nameMAC []byte
+	nameKey cipher.Block
+}
+
+// NewCipher creates a cipher from the master key. Separate keys for the contents and the names are derived from it.
+func NewCipher(key []byte, names bool) (*Cipher, error) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+
+	nameKey, err := aes.NewCipher(derive("goback name"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{
+		key:     derive("goback content"),
+		names:   names,
+		nameMAC: derive("goback name iv"),
+		nameKey: nameKey,
+	}, nil
+}
+
+// NewEncryptionParameters creates the parameters for a new target. A passphrase is stretched using PBKDF2 with a random
+// salt, a key file is used as it is.
+func NewEncryptionParameters(keyFile bool, names bool) (*EncryptionParameters, error) {
+	if keyFile {
+		return &EncryptionParameters{KDF: KDFKeyFile, Names: names}, nil
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptionParameters{
+		KDF:        KDFPBKDF2,
+		Iterations: KDFIterationsDefault,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Names:      names,
+	}, nil
+}
+
+// Cipher derives the key using the parameters from the passphrase or the key file given in the arguments
+func (params *EncryptionParameters) Cipher(args *Arguments) (*Cipher, error) {
+	var key []byte
+
+	switch params.KDF {
+	case KDFKeyFile:
+		if args.KeyFile == "" {
+			return nil, errors.New("the key file of the encrypted target must be given using -key-file")
+		}
+		data, err := ioutil.ReadFile(args.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = data
+		if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			key = decoded
+		}
+		if len(key) != 32 {
+			return nil, errors.New("the key file must contain 32 bytes, either binary or hex encoded")
+		}
+
+	case KDFPBKDF2:
+		passphrase := os.Getenv(PassphraseEnvironment)
+		if args.PassphraseFile != "" {
+			data, err := ioutil.ReadFile(args.PassphraseFile)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = strings.TrimRight(string(data), "\r\n")
+		}
+		if passphrase == "" {
+			return nil, errors.New("the passphrase of the encrypted target must be given using -passphrase-file or " + PassphraseEnvironment)
+		}
+		salt, err := base64.StdEncoding.DecodeString(params.Salt)
+		if err != nil || params.Iterations < 1 {
+			return nil, errors.New("invalid key derivation parameters")
+		}
+		key = pbkdf2.Key([]byte(passphrase), salt, params.Iterations, 32, sha256.New)
+
+	default:
+		return nil, errors.New("unknown key derivation function " + params.KDF)
+	}
+
+	return NewCipher(key, params.Names)
+}
+
+// fileAEAD returns the AEAD sealing the chunks of a file using the key derived from the content key and the salt of
+// the file
+func (c *Cipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.key, salt, []byte("goback file")), key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Path returns the path of a file on the target. If the names are encrypted, every element of the path is encrypted
+// deterministically, so the same path always results in the same name. Names that would be too long once encrypted are
+// replaced by their keyed hash. The names are never decrypted, the original paths are only read from the hashes.
+func (c *Cipher) Path(filePath string) string {
+	if c == nil || !c.names {
+		return filePath
+	}
+
+	elements := strings.Split(filePath, "/")
+	for i, element := range elements {
+		mac := hmac.New(sha256.New, c.nameMAC)
+		_, _ = mac.Write([]byte(element))
+		sum := mac.Sum(nil)
+		if base64.RawURLEncoding.EncodedLen(aes.BlockSize+len(element)) > encryptedNameMax {
+			elements[i] = encryptedNameHashed + base64.RawURLEncoding.EncodeToString(sum)
+			continue
+		}
+		iv := sum[:aes.BlockSize]
+
+		name := make([]byte, aes.BlockSize+len(element))
+		copy(name, iv)
+		cipher.NewCTR(c.nameKey, iv).XORKeyStream(name[aes.BlockSize:], []byte(element))
+		elements[i] = base64.RawURLEncoding.EncodeToString(name)
+	}
+
+	return strings.Join(elements, "/")
+}
+
+// Size returns the size of an encrypted file containing the given amount of data
+func (c *Cipher) Size(size int64) int64 {
+	if c == nil {
+		return size
+	}
+
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptionHeaderSize) + size + chunks*encryptionOverhead
+}
+
+// Writer returns a writer that encrypts the data written to it. Close must be called to write the last chunk, it does
+// not close the underlying writer.
+func (c *Cipher) Writer(writer io.Writer) (io.WriteCloser, error) {
+	if c == nil {
+		return nopWriteCloser{writer}, nil
+	}
+
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	_, err := rand.Read(header[len(encryptionMagic):])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.fileAEAD(header[len(encryptionMagic) : len(encryptionMagic)+encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		aead:   aead,
+		writer: writer,
+		prefix: header[len(encryptionMagic)+encryptionSaltSize:],
+		buffer: make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+// Reader returns a reader that decrypts the data read from the given one
+func (c *Cipher) Reader(reader io.Reader) (io.Reader, error) {
+	if c == nil {
+		return reader, nil
+	}
+
+	buffered := bufio.NewReader(reader)
+	header := make([]byte, encryptionHeaderSize)
+	_, err := io.ReadFull(buffered, header)
+	if err != nil || !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return nil, errors.New("the data is not encrypted")
+	}
+	aead, err := c.fileAEAD(header[len(encryptionMagic) : len(encryptionMagic)+encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		aead:   aead,
+		reader: buffered,
+		prefix: header[len(encryptionMagic)+encryptionSaltSize:],
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Seal encrypts the given data
+func (c *Cipher) Seal(data []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer, err := c.Writer(buffer)
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+
+	return buffer.Bytes(), err
+}
+
+// Open decrypts the given data
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	reader, err := c.Reader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// isEncrypted returns true if the data starts like an encrypted file
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// nonce returns the nonce of a chunk of a file
+func nonce(aead cipher.AEAD, prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptingWriter struct {
+	aead    cipher.AEAD
+	writer  io.Writer
+	prefix  []byte
+	counter uint32
+	buffer  []byte
+}
+
+func (w *encryptingWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		// A full chunk is only sealed when more data follows, so the last chunk can be marked on Close
+		if len(w.buffer) == encryptionChunkSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buffer[len(w.buffer):encryptionChunkSize], data)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		data = data[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *encryptingWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.aead, w.prefix, w.counter, last), w.buffer, nil)
+	w.counter++
+	w.buffer = w.buffer[:0]
+
+	_, err := w.writer.Write(sealed)
+	return err
+}
+
+type decryptingReader struct {
+	aead    cipher.AEAD
+	reader  *bufio.Reader
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func (r *decryptingReader) Read(data []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.reader, r.chunk)
+		last := false
+		if err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err == io.EOF {
+			return 0, errors.New("encrypted data is truncated")
+		} else if err != nil {
+			return 0, err
+		} else if _, err := r.reader.Peek(1); err == io.EOF {
+			last = true
+		}
+
+		r.plain, err = r.aead.Open(r.chunk[:0:0], nonce(r.aead, r.prefix, r.counter, last), r.chunk[:n], nil)
+		if err != nil {
+			return 0, errors.New("encrypted data is corrupt or the key is wrong")
+		}
+		r.counter++
+		r.done = last
+	}
+
+	n := copy(data, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Deduplication modes
+const (
+	DedupNone     = "none"     // Every file is stored on its own
+	DedupSnapshot = "snapshot" // Identical files in a backup are hard-linked
+	DedupAll      = "all"      // Identical files in a backup and in all older backups are hard-linked
+)
+
+// DedupIndex finds files with the same content by their SHA-256 digest. It is safe to use from several goroutines.
+type DedupIndex struct {
+	files map[string]*dedupFile // File with the content for every digest
+	mutex sync.Mutex
+}
+
+// dedupFile is a file in the index, which may still be being stored
+type dedupFile struct {
+	path   string
+	stored chan struct{} // Closed once the file is stored or storing it failed
+}
+
+// storedFile is closed for the files that are stored already
+var storedFile = func() chan struct{} {
+	stored := make(chan struct{})
+	close(stored)
+	return stored
+}()
+
+// NewDedupIndex creates an empty index
+func NewDedupIndex() *DedupIndex {
+	return &DedupIndex{files: map[string]*dedupFile{}}
+}
+
+// Add records that the file at the given path has the given content. Files already known are kept.
+func (index *DedupIndex) Add(digest, path string) {
+	if index == nil || digest == "" {
+		return
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if _, found := index.files[digest]; !found {
+		index.files[digest] = &dedupFile{path: path, stored: storedFile}
+	}
+}
+
+// Claim returns the path of a file with the given content once it is stored. If there is none, the given path is
+// recorded for the content and the returned function must be called once the file is stored or storing it failed.
+// Until then, claims of the same content wait for it.
+func (index *DedupIndex) Claim(digest, path string) (string, func()) {
+	index.mutex.Lock()
+	file, found := index.files[digest]
+	if !found {
+		file = &dedupFile{path: path, stored: make(chan struct{})}
+		index.files[digest] = file
+	}
+	index.mutex.Unlock()
+
+	if !found {
+		return "", func() { close(file.stored) }
+	}
+	<-file.stored
+	return file.path, nil
+}
+
+// AddBackups adds the files with a known digest from the hashes of all backups in the target directory in the storage
+// except the given one. Files that were moved out of an older backup since are skipped when linking. The hashes and
+// names of encrypted backups are decrypted using the given cipher.
+func (index *DedupIndex) AddBackups(storage Storage, targetDirectory, except string, cipher *Cipher) {
+	files, err := storage.List(targetDirectory)
+	if err != nil {
+		Log.F(OutputLevelWarning, "Could not read older backups in %s: %s", targetDirectory, err.Error())
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		dir := filepath.Join(targetDirectory, strings.TrimSuffix(name, "."+HashesExtension))
+		if file.IsDir() || name == ConfigurationFile || !strings.HasSuffix(name, "."+HashesExtension) || dir == except || !storageDirectoryExists(storage, dir) {
+			continue
+		}
+
+		hashes, _, err := ReadManifest(storage, filepath.Join(targetDirectory, name), cipher)
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not read hashes from %s: %s", name, err.Error())
+			continue
+		}
+
+		for filePath, entry := range hashes {
+			if entry.Type == EntryTypeFile && !entry.Inconsistent {
+				index.Add(entry.Digest, filepath.Join(dir, cipher.Path(filePath)))
+			}
+		}
+	}
+}
+
+// prepareDedup creates the index of files with known content if deduplication is enabled
+func (backup *Backup) prepareDedup() {
+	switch backup.Configuration.Dedup {
+	case DedupSnapshot:
+		backup.Dedup = NewDedupIndex()
+	case DedupAll:
+		backup.Dedup = NewDedupIndex()
+		backup.Dedup.AddBackups(backup.Storage, backup.Configuration.targetDirectory, backup.To, backup.Options.Cipher)
+	}
+}
+
+// copyOptions returns the options for copying the given file and a function to call once it is stored. With
+// deduplication, the copy is replaced by a link to a file with the same content once its digest is known, so the file
+// is only read once. If there is no such file, the copy is claimed for its content, so identical files copied at the
+// same time wait for it and are linked to it.
+func (backup *Backup) copyOptions(log *LogBuffer, pathOri string) (*CopyOptions, func()) {
+	if backup.Dedup == nil {
+		return &backup.Options, func() {}
+	}
+
+	stored := func() {}
+	options := backup.Options
+	options.Duplicate = func(digest string, size int64, destination string) bool {
+		if size == 0 {
+			return false
+		}
+		existing, release := backup.Dedup.Claim(digest, destination)
+		if release != nil {
+			stored = release
+			return false
+		}
+		return backup.linkDuplicate(log, pathOri, existing, size, destination)
+	}
+	return &options, func() { stored() }
+}
+
+// linkDuplicate hard-links the destination from the existing file with the same content. Returns false if that is not
+// possible and the copy has to be kept.
+func (backup *Backup) linkDuplicate(log *LogBuffer, pathOri, existing string, size int64, destination string) bool {
+	if existing == destination {
+		// Copied again as the file changed
+		return false
+	}
+
+	// Older backups are incomplete, the file may have been moved into a newer one or storing it failed
+	info, err := backup.Storage.Stat(existing)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != backup.Options.Cipher.Size(size) {
+		return false
+	}
+
+	linker, canLink := backup.Storage.(storageLinker)
+	if !canLink || linker.Link(existing, destination, &backup.Options) != nil {
+		return false
+	}
+
+	log.F(OutputLevelInfo, "Linking duplicate of %s: %s", existing, pathOri)
+	backup.Statistics.AddLink(size)
+
+	return true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DeltaExtension is appended to the path of an older version of a file that is stored as a delta against the version
+// in the next newer backup
+const DeltaExtension = ".gobackdelta"
+
+// DeltaBlockSize is the size of the blocks that are compared between the versions
+const DeltaBlockSize = 64 * 1024
+
+// DeltaMinSize is the minimum size of a file to be stored as a delta. Smaller files are stored completely.
+const DeltaMinSize = 1024 * 1024
+
+// deltaMagic starts every delta file, the last byte is the version of the format
+var deltaMagic = []byte("GOBACKDELTA\x01")
+
+// deltaHeader follows the magic bytes. It is followed by records consisting of the number of a block as uint64 and the
+// content of the block in the older version. All numbers are little endian.
+type deltaHeader struct {
+	BlockSize uint32
+	Size      uint64   // Size of the older version
+	Digest    [32]byte // SHA-256 digest of the older version
+}
+
+// writeDelta stores the file at oldPath as the blocks that differ from the file at basePath. Returns false if the
+// delta would not be smaller than half of the file, in which case nothing is written. Encrypted files are decrypted
+// for comparing them and the delta is encrypted using the given cipher.
+func writeDelta(storage Storage, oldPath, basePath, deltaPath string, sync bool, cipher *Cipher) (bool, error) {
+	// Files in a storage cannot be changed once written, so the header has to be complete from the start. The size and
+	// the digest of the older version are determined in an additional pass.
+	size, digest, err := plainSizeAndDigest(storage, oldPath, cipher)
+	if err != nil {
+		return false, err
+	}
+	header := deltaHeader{BlockSize: DeltaBlockSize, Size: uint64(size)}
+	copy(header.Digest[:], digest)
+
+	oldFile, err := storage.Read(oldPath)
+	if err != nil {
+		return false, err
+	}
+	defer LogError(oldFile.Close)
+
+	old, err := cipher.Reader(oldFile)
+	if err != nil {
+		return false, err
+	}
+
+	baseFile, err := storage.Read(basePath)
+	if err != nil {
+		return false, err
+	}
+	defer LogError(baseFile.Close)
+
+	base, err := cipher.Reader(baseFile)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := storage.Put(deltaPath)
+	if err != nil {
+		return false, err
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			out.Abort()
+		}
+	}()
+
+	writer, err := cipher.Writer(out)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = writer.Write(deltaMagic)
+	if err == nil {
+		err = binary.Write(writer, binary.LittleEndian, &header)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	written := int64(len(deltaMagic) + binary.Size(header))
+	oldBlock := make([]byte, DeltaBlockSize)
+	baseBlock := make([]byte, DeltaBlockSize)
+	baseDone := false
+	for block := uint64(0); ; block++ {
+		n, err := io.ReadFull(old, oldBlock)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+
+		baseN := 0
+		if !baseDone {
+			baseN, err = io.ReadFull(base, baseBlock)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				baseDone = true
+			} else if err != nil {
+				return false, err
+			}
+		}
+
+		if baseN >= n && bytes.Equal(oldBlock[:n], baseBlock[:n]) {
+			continue
+		}
+
+		err = binary.Write(writer, binary.LittleEndian, block)
+		if err == nil {
+			_, err = writer.Write(oldBlock[:n])
+		}
+		if err != nil {
+			return false, err
+		}
+		written += 8 + int64(n)
+		if written > int64(header.Size)/2 {
+			return false, nil
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return false, err
+	}
+
+	stored = true
+	return true, out.Commit(sync)
+}
+
+// plainSizeAndDigest returns the size and the SHA-256 digest of the decrypted content of the file in the storage
+func plainSizeAndDigest(storage Storage, path string, cipher *Cipher) (int64, []byte, error) {
+	file, err := storage.Read(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer LogError(file.Close)
+
+	reader, err := cipher.Reader(file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, hash.Sum(nil), nil
+}
+
+// applyDelta reconstructs the older version of a file from the delta in the storage and the newer version at basePath
+// in the local filesystem. An encrypted delta is decrypted using the given cipher, the newer version must already be
+// decrypted.
+func applyDelta(storage Storage, deltaPath, basePath, destination string, cipher *Cipher) error {
+	deltaFile, err := storage.Read(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer LogError(deltaFile.Close)
+
+	delta, err := cipher.Reader(deltaFile)
+	if err != nil {
+		return err
+	}
+
+	magic := make([]byte, len(deltaMagic))
+	_, err = io.ReadFull(delta, magic)
+	if err != nil || !bytes.Equal(magic, deltaMagic) {
+		return fmt.Errorf("%s is not a delta of a supported version", deltaPath)
+	}
+
+	header := deltaHeader{}
+	err = binary.Read(delta, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+
+	base, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	defer LogError(base.Close)
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer LogError(out.Close)
+
+	_, err = io.Copy(out, io.LimitReader(base, int64(header.Size)))
+	if err == nil {
+		err = out.Truncate(int64(header.Size))
+	}
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, header.BlockSize)
+	for {
+		var number uint64
+		err = binary.Read(delta, binary.LittleEndian, &number)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		offset := number * uint64(header.BlockSize)
+		if offset >= header.Size {
+			return fmt.Errorf("invalid block %d in %s", number, deltaPath)
+		}
+		length := header.Size - offset
+		if length > uint64(header.BlockSize) {
+			length = uint64(header.BlockSize)
+		}
+
+		_, err = io.ReadFull(delta, block[:length])
+		if err == nil {
+			_, err = out.WriteAt(block[:length], int64(offset))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	digest, err := fileDigest(destination, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, header.Digest[:]) {
+		return errors.New("the reconstructed data differs from the original file")
+	}
+
+	return nil
+}
+
+// storeDelta replaces the older version of a changed file in the reference by a delta against the new version, if the
+// file is large enough and the delta is small enough
+func (backup *Backup) storeDelta(log *LogBuffer, filePath string) {
+	pathRef := backup.targetPath(backup.Ref, filePath)
+	info, err := backup.Storage.Stat(pathRef)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < DeltaMinSize {
+		return
+	}
+
+	stored, err := writeDelta(backup.Storage, pathRef, backup.targetPath(backup.To, filePath), pathRef+DeltaExtension, backup.Options.syncFiles(), backup.Options.Cipher)
+	if err != nil {
+		log.F(OutputLevelWarning, "Could not store %s as delta, keeping it completely: %s", pathRef, err.Error())
+		return
+	} else if !stored {
+		return
+	}
+
+	err = backup.Storage.Delete(pathRef)
+	if err != nil {
+		log.F(OutputLevelWarning, "Could not remove %s after storing it as delta: %s", pathRef, err.Error())
+		_ = backup.Storage.Delete(pathRef + DeltaExtension)
+		return
+	}
+
+	log.F(OutputLevelInfo, "Stored last version as delta: %s", pathRef)
+}
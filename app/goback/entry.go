@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of files in a manifest
+const (
+	EntryTypeFile    = "file"
+	EntryTypeSymlink = "symlink"
+	EntryTypeOther   = "other"
+)
+
+// ManifestEntry describes a file in a backup and is used for change detection
+type ManifestEntry struct {
+	ModTime int64       `json:"mtime"` // Modification time in nanoseconds since the epoch
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	Type    string      `json:"type"`
+	Inode   uint64      `json:"inode,omitempty"`
+	Device  uint64      `json:"device,omitempty"`
+	Digest  string      `json:"digest,omitempty"` // Digest of the content if it is known
+
+	// Codec is the name of the codec the file is compressed with in an older backup
+	Codec string `json:"codec,omitempty"`
+
+	// RenamedFrom is the path of the file in the last backup if it was detected as renamed
+	RenamedFrom string `json:"renamedfrom,omitempty"`
+
+	// Inconsistent is set if the file kept changing while it was copied, so the content in the backup may be corrupt
+	Inconsistent bool `json:"inconsistent,omitempty"`
+
+	// Hash of manifests written by older versions, which only contain the modification time in seconds and the size
+	legacy string
+}
+
+// NewManifestEntry creates the entry for the given file
+func NewManifestEntry(info os.FileInfo) *ManifestEntry {
+	entry := &ManifestEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+		Mode:    info.Mode().Perm(),
+		Type:    EntryTypeOther,
+	}
+
+	if info.Mode().IsRegular() {
+		entry.Type = EntryTypeFile
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		entry.Type = EntryTypeSymlink
+	}
+
+	entry.Inode, entry.Device = fileInode(info)
+
+	return entry
+}
+
+// ParseLegacyEntry converts a hash of the format "modification time|size" used by older versions into an entry
+func ParseLegacyEntry(hash string) *ManifestEntry {
+	entry := &ManifestEntry{
+		Type:   EntryTypeFile,
+		legacy: hash,
+	}
+
+	separator := strings.LastIndex(hash, "|")
+	if separator < 0 {
+		return entry
+	}
+
+	modTime, err := time.ParseInLocation(TimestampFormatHash, hash[:separator], time.Local)
+	if err == nil {
+		entry.ModTime = modTime.UnixNano()
+	}
+
+	entry.Size, _ = strconv.ParseInt(hash[separator+1:], 10, 64)
+
+	return entry
+}
+
+// Unchanged returns true if the file described by the entry has not changed compared to the other one. The inode and
+// device are not compared, because they change when the backup is moved to another filesystem.
+func (entry *ManifestEntry) Unchanged(other *ManifestEntry) bool {
+	if entry == nil || other == nil || entry.Inconsistent || other.Inconsistent {
+		return false
+	}
+
+	// Older manifests can only be compared with the precision they were written with
+	if entry.legacy != "" || other.legacy != "" {
+		return entry.legacyHash() == other.legacyHash()
+	}
+
+	return entry.ModTime == other.ModTime && entry.Size == other.Size && entry.Type == other.Type
+}
+
+func (entry *ManifestEntry) legacyHash() string {
+	if entry.legacy != "" {
+		return entry.legacy
+	}
+
+	return time.Unix(0, entry.ModTime).Format(TimestampFormatHash) + "|" + strconv.FormatInt(entry.Size, 10)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileInode is not supported on this platform
+func fileInode(info os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
+
+// fileOwner is not supported on this platform
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// fileAccessTime is not supported on this platform, the modification time is used instead
+func fileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -22,7 +22,20 @@ func (*Exit) showHelp() {
 	echo("    goback [-type daily] [-change modsize] [-level 3] -source SOURCE TARGET \n")
 	echo("\n")
 	echo("  Subsequent backups:\n")
-	echo("    goback [-type daily] [-level 3] [-source SOURCE] TARGET\n")
+	echo("    goback [-type daily] [-level 3] [-source SOURCE] [-max-change 30] [-force] TARGET\n")
+	echo("\n")
+	echo("  Restore a backup:\n")
+	echo("    goback -restore latest -restore-to DIRECTORY TARGET\n")
+	echo("\n")
+	echo("  Verify a backup:\n")
+	echo("    goback -verify-backup latest TARGET\n")
+	echo("\n")
+	echo("  List backups or the files of a backup, show the changes in a backup:\n")
+	echo("    goback -list all|latest|NAME TARGET\n")
+	echo("    goback -diff latest|NAME TARGET\n")
+	echo("\n")
+	echo("  Encrypted targets need the key for every command:\n")
+	echo("    goback -encrypt [-encrypt-names] -passphrase-file FILE|-key-file FILE -source SOURCE TARGET\n")
 	echo("\n")
 	echo("The arguments from the first backup will be saved inside the configuration (except level)\n")
 	echo("\n")
@@ -1,25 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 )
 
-// ReadJSON reads the given file and fills the given structure pointer, returns true ans second return in case the file is not found
-func ReadJSON(path string, structure interface{}) (bool, error) {
+// ReadJSON reads the given file from the storage and fills the given structure pointer, returns true ans second return in case the file is not found
+func ReadJSON(storage Storage, path string, structure interface{}) (bool, error) {
 	Log.F(OutputLevelDebug, "Reading from %s", path)
 
-	data, err := ioutil.ReadFile(path)
+	file, err := storage.Read(path)
 	if os.IsNotExist(err) {
 		Log.F(OutputLevelDebug, "File does not exist: %s", path)
 		return false, nil
 	} else if err != nil {
 		return false, err
 	}
+	defer LogError(file.Close)
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
 
 	err = json.Unmarshal(data, structure)
 	if err != nil {
@@ -29,8 +43,10 @@ func ReadJSON(path string, structure interface{}) (bool, error) {
 	return true, nil
 }
 
-// WriteJSON writes a JSON representation for the given structure into the given path
-func WriteJSON(path string, structure interface{}) error {
+// WriteJSON writes a JSON representation for the given structure into the given path of the storage. The data is
+// written into a temporary file that replaces the file afterwards, so the file is never left half-written. If sync is
+// set, the data and the rename are flushed to disk.
+func WriteJSON(storage Storage, path string, structure interface{}, sync bool) error {
 	Log.F(OutputLevelDebug, "Writing to %s", path)
 
 	data, err := json.Marshal(structure)
@@ -38,12 +54,35 @@ func WriteJSON(path string, structure interface{}) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(path, data, os.ModePerm)
+	file, err := storage.Put(path)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = file.Write(data)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+
+	return file.Commit(sync)
+}
+
+// SyncDirectory flushes the entries of the given directory to disk, so renames in it survive a power failure
+func SyncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer LogError(dir.Close)
+
+	err = dir.Sync()
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL {
+		// Not all filesystems support syncing directories
+		return nil
+	}
+
+	return err
 }
 
 // DirectoryExists returns true if the given path exists and is a directory
@@ -64,10 +103,175 @@ func DirectoryExists(dir string) bool {
 	return true
 }
 
+// IsInsideDirectory returns true if path is the given directory or lies somewhere below it. Symlinks are resolved
+// for both paths before comparing them
+func IsInsideDirectory(path, directory string) (bool, error) {
+	path, err := resolvePath(path)
+	if err != nil {
+		return false, err
+	}
+
+	directory, err = resolvePath(directory)
+	if err != nil {
+		return false, err
+	}
+
+	relative, err := filepath.Rel(directory, path)
+	if err != nil {
+		// Paths on different volumes cannot be inside each other
+		return false, nil
+	}
+
+	return relative == "." || (relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))), nil
+}
+
+// resolvePath returns the absolute path with all symlinks resolved
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(path)
+}
+
+// CopyOptions configures how files are copied and moved
+type CopyOptions struct {
+	Statistics *Statistics // Statistics to record the copies in, optional
+	Durability string      // Which data to flush to disk
+	Throttle   *Throttle   // Limits for the bandwidth and the number of files, optional
+	Verify     bool        // Whether to read copied files back from disk and compare them with the source
+	Cipher     *Cipher     // Encrypts the copied data, optional
+
+	// Directories collects the directories to flush once at the end instead of after every file, optional
+	Directories *DirectorySync
+
+	// Duplicate links the destination from a file with the given content instead of storing the copy and returns true,
+	// or returns false if there is no such file, optional
+	Duplicate func(digest string, size int64, destination string) bool
+}
+
+// cipher returns the cipher to encrypt copies with or nil if they are not encrypted
+func (options *CopyOptions) cipher() *Cipher {
+	if options == nil {
+		return nil
+	}
+	return options.Cipher
+}
+
+// throttle returns the limits to apply or nil if nothing is limited
+func (options *CopyOptions) throttle() *Throttle {
+	if options == nil {
+		return nil
+	}
+	return options.Throttle
+}
+
+// verify returns true if copied files have to be verified
+func (options *CopyOptions) verify() bool {
+	return options != nil && options.Verify
+}
+
+// duplicate links the destination from a file with the given content if there is one and returns true in that case
+func (options *CopyOptions) duplicate(digest []byte, size int64, destination string) bool {
+	return options != nil && options.Duplicate != nil && options.Duplicate(hex.EncodeToString(digest), size, destination)
+}
+
+// syncFiles returns true if copied files and renames have to be flushed to disk
+func (options *CopyOptions) syncFiles() bool {
+	return options != nil && options.Durability == DurabilityFull
+}
+
+// syncDirectories flushes the entries of the given directories to disk if files have to be flushed. If the directories
+// are collected, they are flushed later.
+func (options *CopyOptions) syncDirectories(directories ...string) *Exit {
+	if !options.syncFiles() {
+		return nil
+	}
+	if options.Directories != nil {
+		options.Directories.Add(directories...)
+		return nil
+	}
+
+	return syncDirectories(directories...)
+}
+
+// createDirectories creates the directory and its parents if needed. The parents of the directories created are flushed
+// like the directories of the files.
+func (options *CopyOptions) createDirectories(directory string) error {
+	created := []string{}
+	for dir := directory; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(directory, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range created {
+		exit := options.syncDirectories(filepath.Dir(dir))
+		if exit != nil {
+			return errors.New(exit.Message)
+		}
+	}
+
+	return nil
+}
+
+// DirectorySync collects the directories in which files were renamed or created, so each one is flushed to disk once
+type DirectorySync struct {
+	directories map[string]bool
+	mutex       sync.Mutex
+}
+
+// Add records the directories to be flushed
+func (directorySync *DirectorySync) Add(directories ...string) {
+	directorySync.mutex.Lock()
+	defer directorySync.mutex.Unlock()
+
+	if directorySync.directories == nil {
+		directorySync.directories = map[string]bool{}
+	}
+	for _, directory := range directories {
+		directorySync.directories[directory] = true
+	}
+}
+
+// Sync flushes the recorded directories to disk
+func (directorySync *DirectorySync) Sync() *Exit {
+	if directorySync == nil {
+		return nil
+	}
+
+	directorySync.mutex.Lock()
+	defer directorySync.mutex.Unlock()
+
+	directories := make([]string, 0, len(directorySync.directories))
+	for directory := range directorySync.directories {
+		directories = append(directories, directory)
+	}
+	sort.Strings(directories)
+
+	exit := syncDirectories(directories...)
+	if exit != nil {
+		return exit
+	}
+	directorySync.directories = nil
+
+	return nil
+}
+
 // MoveFile renames a file and creates directories if needed
-func MoveFile(source, destination string) *Exit {
+func MoveFile(source, destination string, options *CopyOptions) *Exit {
 	destinationDir := filepath.Dir(destination)
-	err := os.MkdirAll(destinationDir, os.ModePerm)
+	err := options.createDirectories(destinationDir)
 	if err != nil {
 		return &Exit{
 			Message: fmt.Sprintf("Creating folder %s: %s", destinationDir, err.Error()),
@@ -76,31 +280,281 @@ func MoveFile(source, destination string) *Exit {
 	}
 
 	err = os.Rename(source, destination)
-	if err != nil {
+	if isCrossDevice(err) {
+		// Parts of the target can be mounted from another device
+		Log.F(OutputLevelDebug, "Moving %s across devices", source)
+		return moveAcrossDevices(source, destination, options)
+	} else if err != nil {
 		return &Exit{
 			Message: fmt.Sprintf("Moving file to %s: %s", destination, err.Error()),
 			Code:    ExitcodeCopyCreateDir,
 		}
 	}
 
+	return options.syncDirectories(filepath.Dir(source), destinationDir)
+}
+
+// syncDirectories flushes the entries of the given directories to disk
+func syncDirectories(directories ...string) *Exit {
+	for _, directory := range directories {
+		err := SyncDirectory(directory)
+		if err != nil {
+			return &Exit{
+				Message: fmt.Sprintf("Syncing directory %s: %s", directory, err.Error()),
+				Code:    ExitcodeSync,
+			}
+		}
+	}
+
 	return nil
 }
 
-// CopyFile creates a new file and directories if needed and copies the data from source to destination
-func CopyFile(source, destination string) *Exit {
-	in, err := os.Open(source)
+// isCrossDevice returns true if the error was caused by renaming a file to another device
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// moveAcrossDevices moves a file by copying it and deleting the source afterwards. The copy is verified and gets the
+// metadata of the source before it is renamed to the destination. As the source is the only other copy, the copy is
+// always flushed to disk before the source is removed, regardless of the durability level. Symbolic links are created
+// again instead of copying their target.
+func moveAcrossDevices(source, destination string, options *CopyOptions) *Exit {
+	info, err := os.Lstat(source)
 	if err != nil {
 		return &Exit{
+			Message: fmt.Sprintf("Reading %s: %s", source, err.Error()),
+			Code:    ExitcodeCopyRead,
+		}
+	}
+
+	pathTmp := destination + ".part"
+	if info.Mode()&os.ModeSymlink != 0 {
+		var link string
+		link, err = os.Readlink(source)
+		if err == nil {
+			err = os.Symlink(link, pathTmp)
+		}
+		if err != nil {
+			return &Exit{
+				Message: fmt.Sprintf("Copying link %s: %s", source, err.Error()),
+				Code:    ExitcodeCopyCreate,
+			}
+		}
+	} else {
+		digest, exit := copyToFile(source, pathTmp, true, options.throttle())
+		if exit != nil {
+			return exit
+		}
+
+		exit = verifyFile(pathTmp, digest, nil)
+		if exit != nil {
+			_ = os.Remove(pathTmp)
+			return exit
+		}
+
+		err = copyMetadata(pathTmp, info)
+		if err != nil {
+			_ = os.Remove(pathTmp)
+			return &Exit{
+				Message: fmt.Sprintf("Setting metadata of %s: %s", pathTmp, err.Error()),
+				Code:    ExitcodeCopyWrite,
+			}
+		}
+	}
+
+	err = os.Rename(pathTmp, destination)
+	if err != nil {
+		_ = os.Remove(pathTmp)
+		return &Exit{
+			Message: fmt.Sprintf("Renaming %s: %s", pathTmp, err.Error()),
+			Code:    ExitcodeCopyRename,
+		}
+	}
+
+	// The copy must be on disk before the source is removed
+	exit := syncDirectories(filepath.Dir(destination))
+	if exit != nil {
+		return exit
+	}
+
+	err = os.Remove(source)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("Removing %s after moving it: %s", source, err.Error()),
+			Code:    ExitcodeCopyCreateDir,
+		}
+	}
+
+	return options.syncDirectories(filepath.Dir(source))
+}
+
+// copyToFile copies the source into a new file and returns the SHA-256 digest of the data written. If sync is set,
+// the data is flushed to disk and dropped from the cache, so it is read back from the disk. The data is read within the
+// limits of the throttle.
+func copyToFile(source, destination string, sync bool, throttle *Throttle) ([]byte, *Exit) {
+	in, err := os.Open(source)
+	if err != nil {
+		return nil, &Exit{
 			Message: fmt.Sprintf("Opening %s: %s", source, err.Error()),
 			Code:    ExitcodeCopyRead,
 		}
 	}
 	defer LogError(in.Close)
 
+	out, err := os.Create(destination)
+	if err != nil {
+		return nil, &Exit{
+			Message: fmt.Sprintf("Creating file %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyCreate,
+		}
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), throttle.Reader(in))
+	if err == nil && sync {
+		err = out.Sync()
+		if err == nil {
+			dropCache(out)
+		}
+	}
+	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(destination)
+		return nil, &Exit{
+			Message: fmt.Sprintf("Writing to %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyWrite,
+		}
+	}
+
+	if err = out.Close(); err != nil {
+		_ = os.Remove(destination)
+		return nil, &Exit{
+			Message: fmt.Sprintf("Closing %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyClose,
+		}
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// verifyFile reads the given file and compares its SHA-256 digest with the expected one. Encrypted files are
+// decrypted using the given cipher first.
+func verifyFile(path string, expected []byte, cipher *Cipher) *Exit {
+	digest, err := fileDigest(path, cipher)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("Verifying %s: %s", path, err.Error()),
+			Code:    ExitcodeCopyVerify,
+		}
+	}
+
+	if !bytes.Equal(digest, expected) {
+		return &Exit{
+			Message: fmt.Sprintf("Verifying %s: The data written differs from the source", path),
+			Code:    ExitcodeCopyVerify,
+		}
+	}
+
+	return nil
+}
+
+// fileDigest returns the SHA-256 digest of the content of the given file. Encrypted files are decrypted using the given
+// cipher, so the digest matches the one of the original file.
+func fileDigest(path string, cipher *Cipher) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer LogError(file.Close)
+
+	return readDigest(file, cipher)
+}
+
+// readDigest returns the SHA-256 digest of the data read from the reader, which is decrypted using the given cipher
+func readDigest(file io.Reader, cipher *Cipher) ([]byte, error) {
+	reader, err := cipher.Reader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// copyMetadata sets the permissions, modification time and, if possible, the owner of the file to the given ones
+func copyMetadata(path string, info os.FileInfo) error {
+	err := os.Chmod(path, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(path, fileAccessTime(info), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	// Only privileged users can change the owner
+	uid, gid, ok := fileOwner(info)
+	if ok && os.Getuid() == 0 {
+		return os.Lchown(path, uid, gid)
+	}
+
+	return nil
+}
+
+// LinkFile creates a hard link and directories if needed
+func LinkFile(source, destination string, options *CopyOptions) *Exit {
 	destinationDir := filepath.Dir(destination)
-	err = os.MkdirAll(destinationDir, os.ModePerm)
+	err := options.createDirectories(destinationDir)
 	if err != nil {
 		return &Exit{
+			Message: fmt.Sprintf("Creating folder %s: %s", destinationDir, err.Error()),
+			Code:    ExitcodeCopyCreateDir,
+		}
+	}
+
+	err = os.Link(source, destination)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("Linking file to %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyCreate,
+		}
+	}
+
+	return options.syncDirectories(destinationDir)
+}
+
+// CopyFile creates a new file and directories if needed and copies the data from source to destination. If the copy is
+// verified, encrypted or deduplicated, the SHA-256 digest of the data is returned in hex encoding, otherwise an empty
+// string. A deduplicated copy is discarded if the destination is linked from a file with the same content instead.
+func CopyFile(source, destination string, options *CopyOptions) (string, *Exit) {
+	in, err := os.Open(source)
+	if err != nil {
+		return "", &Exit{
+			Message: fmt.Sprintf("Opening %s: %s", source, err.Error()),
+			Code:    ExitcodeCopyRead,
+		}
+	}
+	defer LogError(in.Close)
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", &Exit{
+			Message: fmt.Sprintf("Reading %s: %s", source, err.Error()),
+			Code:    ExitcodeCopyRead,
+		}
+	}
+
+	destinationDir := filepath.Dir(destination)
+	err = options.createDirectories(destinationDir)
+	if err != nil {
+		return "", &Exit{
 			Message: fmt.Sprintf("Creating target directory %s: %s", destinationDir, err.Error()),
 			Code:    ExitcodeCopyCreateDir,
 		}
@@ -109,46 +563,107 @@ func CopyFile(source, destination string) *Exit {
 	pathTmp := destination + ".part"
 	tmp, err := os.Create(pathTmp)
 	if err != nil {
-		return &Exit{
+		return "", &Exit{
 			Message: fmt.Sprintf("Creating temp file %s: %s", pathTmp, err.Error()),
 			Code:    ExitcodeCopyCreate,
 		}
 	}
 
-	_, err = io.Copy(tmp, in)
+	var method string
+	var digest []byte
+	if options.verify() || options.cipher() != nil || (options != nil && options.Duplicate != nil) {
+		// The data has to pass through the hash and the cipher, so the copy cannot be done by the kernel. For verifying,
+		// it is flushed to disk and dropped from the cache, so it is read back from the disk and not from memory.
+		hash := sha256.New()
+		method = CopyMethodCopy
+		if options.cipher() != nil {
+			method = CopyMethodEncrypted
+		}
+		var writer io.WriteCloser
+		writer, err = options.cipher().Writer(tmp)
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(writer, hash), options.throttle().Reader(in))
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if options.verify() {
+			method = CopyMethodVerified
+			if err == nil {
+				err = tmp.Sync()
+			}
+			if err == nil {
+				dropCache(tmp)
+			}
+		} else if err == nil && options.syncFiles() {
+			err = tmp.Sync()
+		}
+		digest = hash.Sum(nil)
+	} else {
+		method, err = copyData(tmp, in, info.Size(), options.throttle())
+		if err == nil && options.syncFiles() {
+			err = tmp.Sync()
+		}
+	}
 	if err != nil {
 		_ = tmp.Close()
 		_ = os.Remove(tmp.Name())
-		return &Exit{
+		return "", &Exit{
 			Message: fmt.Sprintf("Writing to %s: %s", pathTmp, err.Error()),
 			Code:    ExitcodeCopyWrite,
 		}
 	}
 	if err = tmp.Close(); err != nil {
 		_ = os.Remove(tmp.Name())
-		return &Exit{
+		return "", &Exit{
 			Message: fmt.Sprintf("Closing %s: %s", pathTmp, err.Error()),
 			Code:    ExitcodeCopyClose,
 		}
 	}
 
+	if digest != nil && options.duplicate(digest, info.Size(), destination) {
+		_ = os.Remove(pathTmp)
+		return hex.EncodeToString(digest), nil
+	}
+
+	if options.verify() {
+		exit := verifyFile(pathTmp, digest, options.cipher())
+		if exit != nil {
+			_ = os.Remove(pathTmp)
+			return "", exit
+		}
+	}
+
 	err = os.Rename(pathTmp, destination)
 	if err != nil {
-		return &Exit{
+		return "", &Exit{
 			Message: fmt.Sprintf("Renaming %s: %s", pathTmp, err.Error()),
 			Code:    ExitcodeCopyRename,
 		}
 	}
-	return nil
+
+	exit := options.syncDirectories(destinationDir)
+	if exit != nil {
+		return "", exit
+	}
+
+	if options != nil && options.Statistics != nil {
+		options.Statistics.AddCopy(method, info.Size())
+	}
+
+	if digest == nil {
+		return "", nil
+	}
+	return hex.EncodeToString(digest), nil
 }
 
-// CleanDirectory deletes all empty folders recursively in the given directory
-func CleanDirectory(directory string) *Exit {
+// CleanDirectory deletes all empty folders recursively in the given directory of the storage
+func CleanDirectory(storage Storage, directory string) *Exit {
 	if directory == "" {
 		return nil
 	}
 
-	files, err := ioutil.ReadDir(directory)
+	files, err := storage.List(directory)
 	if err != nil {
 		return &Exit{
 			Message: fmt.Sprintf("Cleaning directory %s: %s", directory, err.Error()),
@@ -160,11 +675,11 @@ func CleanDirectory(directory string) *Exit {
 	for _, file := range files {
 		path := filepath.Join(directory, file.Name())
 		if file.IsDir() {
-			exit := CleanDirectory(path)
+			exit := CleanDirectory(storage, path)
 			if exit != nil {
 				return exit
 			}
-			_, err := os.Stat(path)
+			_, err := storage.Stat(path)
 			if err != nil && os.IsNotExist(err) {
 				// Directory has been deleted. No content for parent
 			} else if err != nil {
@@ -181,8 +696,9 @@ func CleanDirectory(directory string) *Exit {
 	}
 
 	if !hasContent {
-		err := os.Remove(directory)
-		if err != nil {
+		// Storages without real directories remove them with their last file
+		err := storage.Delete(directory)
+		if err != nil && !os.IsNotExist(err) {
 			return &Exit{
 				Message: fmt.Sprintf("Cleaning directory, error deleting %s: %s", directory, err.Error()),
 				Code:    ExitcodeCleanup,
@@ -193,6 +709,22 @@ func CleanDirectory(directory string) *Exit {
 	return nil
 }
 
+// FormatBytes returns a human readable representation of the given number of bytes
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
 // LogError is a helper function to avoid silencing errors when using defer. Use like this: "defer LogError(xxx.Close())"
 func LogError(args ...func() error) {
 	for _, errFn := range args {
@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// SourceIdentity returns the device number of the filesystem the given directory is located on. On an unmounted disk
+// the directory still exists, but is located on the parent filesystem and the device number changes.
+func SourceIdentity(directory string) (string, error) {
+	info, err := os.Stat(directory)
+	if err != nil {
+		return "", err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", nil
+	}
+
+	return fmt.Sprintf("dev%x", stat.Dev), nil
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SourceIdentity returns a string identifying the filesystem the given directory is located on. On an
+// unmounted disk the directory still exists, but is located on the parent filesystem and the identity changes.
+func SourceIdentity(directory string) (string, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(directory, &fs)
+	if err != nil {
+		return "", err
+	}
+
+	if fs.Fsid.X__val[0] != 0 || fs.Fsid.X__val[1] != 0 {
+		return fmt.Sprintf("%x:%08x%08x", fs.Type, uint32(fs.Fsid.X__val[0]), uint32(fs.Fsid.X__val[1])), nil
+	}
+
+	// Some filesystems do not provide an ID, use the device number instead
+	var stat syscall.Stat_t
+	err = syscall.Stat(directory, &stat)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x:dev%x", fs.Type, stat.Dev), nil
+}
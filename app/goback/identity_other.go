@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+// SourceIdentity is not supported on this platform, the check is skipped
+func SourceIdentity(directory string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// ListAll lists all backups instead of the files of one
+const ListAll = "all"
+
+func list(args *Arguments) *Exit {
+	if args.List == ListAll {
+		restore, exit := openTarget(args)
+		if exit != nil {
+			return exit
+		}
+		return restore.listSnapshots(os.Stdout)
+	}
+
+	restore, index, exit := openSnapshot(args, args.List)
+	if exit != nil {
+		return exit
+	}
+
+	return restore.listFiles(index, os.Stdout)
+}
+
+func diff(args *Arguments) *Exit {
+	restore, index, exit := openSnapshot(args, args.Diff)
+	if exit != nil {
+		return exit
+	}
+
+	return restore.diff(index, os.Stdout)
+}
+
+// listSnapshots writes the names of all backups with the number and size of their files
+func (restore *Restore) listSnapshots(out io.Writer) *Exit {
+	for index, name := range restore.Snapshots {
+		hashes, exit := restore.hashes(index)
+		if exit != nil {
+			return exit
+		}
+
+		var size int64
+		for _, entry := range hashes {
+			size += entry.Size
+		}
+		_, _ = fmt.Fprintf(out, "%s %8d files %12s\n", name, len(hashes), FormatBytes(size))
+	}
+
+	return nil
+}
+
+// listFiles writes the files of the backup with the given index with their size and modification time
+func (restore *Restore) listFiles(index int, out io.Writer) *Exit {
+	hashes, exit := restore.hashes(index)
+	if exit != nil {
+		return exit
+	}
+
+	for _, filePath := range sortedKeys(hashes) {
+		entry := hashes[filePath]
+		_, _ = fmt.Fprintf(out, "%12s %s %s\n", FormatBytes(entry.Size), time.Unix(0, entry.ModTime).Format("2006-01-02 15:04:05"), filePath)
+	}
+
+	return nil
+}
+
+// diff writes the files that were added, changed, renamed or deleted in the backup with the given index compared to
+// the backup before it
+func (restore *Restore) diff(index int, out io.Writer) *Exit {
+	hashes, exit := restore.hashes(index)
+	if exit != nil {
+		return exit
+	}
+
+	previous := map[string]*ManifestEntry{}
+	if index > 0 {
+		previous, exit = restore.hashes(index - 1)
+		if exit != nil {
+			return exit
+		}
+	}
+
+	plan := createPlan(hashes, previous)
+	changed := map[string]bool{}
+	for _, filePath := range plan.Changed {
+		changed[filePath] = true
+	}
+	deleted := map[string]bool{}
+	for _, filePath := range plan.Deleted {
+		deleted[filePath] = true
+	}
+
+	added := []string{}
+	renamed := []string{}
+	for _, filePath := range plan.Copy {
+		oldPath := hashes[filePath].RenamedFrom
+		if changed[filePath] {
+			continue
+		} else if oldPath != "" && deleted[oldPath] {
+			renamed = append(renamed, filePath)
+			delete(deleted, oldPath)
+		} else {
+			added = append(added, filePath)
+		}
+	}
+
+	remaining := make([]string, 0, len(deleted))
+	for filePath := range deleted {
+		remaining = append(remaining, filePath)
+	}
+	sort.Strings(remaining)
+
+	for _, filePath := range added {
+		_, _ = fmt.Fprintf(out, "+ %s\n", filePath)
+	}
+	for _, filePath := range plan.Changed {
+		_, _ = fmt.Fprintf(out, "M %s\n", filePath)
+	}
+	for _, filePath := range renamed {
+		_, _ = fmt.Fprintf(out, "R %s -> %s\n", hashes[filePath].RenamedFrom, filePath)
+	}
+	for _, filePath := range remaining {
+		_, _ = fmt.Fprintf(out, "- %s\n", filePath)
+	}
+
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"math"
 	"os"
 	"strings"
+	"sync"
 )
 
 // TIOCGWINSZ value taken from c header file
@@ -35,17 +36,22 @@ var levelTags = map[int]string{
 	OutputLevelError:   "[ERROR] ",
 }
 
-// Logger is a simple way of filering log output
+// Logger is a simple way of filering log output. It is safe to use from several goroutines.
 type Logger struct {
 	Level        int
 	ProgressMax  float64
 	ProgressStep float64
 	NoProgress   bool
+
+	mutex sync.Mutex
 }
 
 // F is like Fprint but prints to Stderr and only of the level is higher than the configured outputlevel
 func (l *Logger) F(level int, format string, args ...interface{}) {
 	if l.Level <= level {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
 		l.clearProgress()
 		fmt.Fprintf(os.Stderr, levelTags[level]+format+"\n", args...)
 		l.currentStep()
@@ -58,6 +64,9 @@ func (l *Logger) ProgressMessage(message string) {
 		return
 	}
 
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	width := getTerminalWidth()
 	if width < 10 {
 		return
@@ -73,6 +82,9 @@ func (l *Logger) Step() {
 		return
 	}
 
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	l.ProgressStep++
 
 	l.currentStep()
@@ -117,6 +129,30 @@ func (l *Logger) clearProgress() {
 	_, _ = fmt.Fprintf(os.Stdout, "\r%s\r", strings.Repeat(" ", int(width)))
 }
 
+// LogBuffer collects log messages, so that messages from concurrent work can be written in a deterministic order
+type LogBuffer struct {
+	entries []logEntry
+}
+
+type logEntry struct {
+	level  int
+	format string
+	args   []interface{}
+}
+
+// F records the message to be written to the logger later on
+func (b *LogBuffer) F(level int, format string, args ...interface{}) {
+	b.entries = append(b.entries, logEntry{level, format, args})
+}
+
+// Flush writes all recorded messages to the given logger
+func (b *LogBuffer) Flush(l *Logger) {
+	for _, entry := range b.entries {
+		l.F(entry.level, entry.format, entry.args...)
+	}
+	b.entries = nil
+}
+
 // TODO: Does this work on windows, mac, etc?
 func getTerminalWidth() float64 {
 	var ts C.winsize
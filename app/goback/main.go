@@ -10,9 +10,34 @@ func main() {
 	// Fill Arguments structure from the command line
 	args := &Arguments{}
 	PerformExit(args.fill())
+	if args.Restore != "" {
+		PerformExit(restore(args))
+		return
+	}
+	if args.VerifyBackup != "" {
+		PerformExit(verifyBackup(args))
+		return
+	}
+	if args.List != "" {
+		PerformExit(list(args))
+		return
+	}
+	if args.Diff != "" {
+		PerformExit(diff(args))
+		return
+	}
 
 	backup := &Backup{}
 	PerformExit(backup.loadConfiguration(args))
+	if backup.Pipeline && !backup.DryRun {
+		PerformExit(backup.stream())
+		return
+	}
 	PerformExit(backup.hash())
+	if backup.DryRun {
+		PerformExit(backup.dryRun())
+		return
+	}
+	PerformExit(backup.check())
 	PerformExit(backup.create())
 }
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ManifestVersion is the version of the manifest format written by this version of goback. Version 1 is a single
+// JSON object mapping the paths to their hashes, version 2 contains a header line followed by one line per file with
+// its hash and version 3 replaces the hash by a structured entry.
+const ManifestVersion = 3
+
+// manifestHeader is the first line of a manifest since version 2
+type manifestHeader struct {
+	Version int `json:"goback-manifest"`
+}
+
+// manifestLine is the representation of a file in a manifest since version 2
+type manifestLine struct {
+	Path string `json:"path"`
+	Hash string `json:"hash,omitempty"` // Only used in version 2
+	ManifestEntry
+}
+
+// ManifestWriter writes the hashes of a backup incrementally. The files must be added in sorted order, so the manifest
+// can be merge-joined with another one. The hashes are written into a temporary file that is renamed when the manifest
+// is finished, so an interrupted backup never leaves an incomplete manifest behind.
+type ManifestWriter struct {
+	path     string
+	file     StorageFile
+	gzip     *gzip.Writer
+	cipher   io.WriteCloser
+	writer   *bufio.Writer
+	encoder  *json.Encoder
+	lastPath string
+	count    int
+	sync     bool
+	mutex    sync.Mutex
+}
+
+// CreateManifest starts writing a new manifest to the given path of the storage, optionally compressed using gzip and
+// encrypted using the given cipher. If sync is set, the manifest is flushed to disk when it is closed.
+func CreateManifest(storage Storage, path string, compress, sync bool, cipher *Cipher) (*ManifestWriter, *Exit) {
+	Log.F(OutputLevelDebug, "Saving hashes in %s", path)
+
+	file, err := storage.Put(path)
+	if err != nil {
+		return nil, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not save hashes in %s: %s", path, err.Error()),
+			Code:    ExitcodeHashesWrite,
+		}
+	}
+
+	manifest := &ManifestWriter{
+		path: path,
+		file: file,
+		sync: sync,
+	}
+
+	// Compressing encrypted data would not save anything, so it is compressed before it is encrypted
+	manifest.cipher, err = cipher.Writer(file)
+	if err != nil {
+		return nil, manifest.fail(err)
+	}
+	if compress {
+		manifest.gzip = gzip.NewWriter(manifest.cipher)
+		manifest.writer = bufio.NewWriter(manifest.gzip)
+	} else {
+		manifest.writer = bufio.NewWriter(manifest.cipher)
+	}
+	manifest.encoder = json.NewEncoder(manifest.writer)
+	manifest.encoder.SetEscapeHTML(false)
+
+	err = manifest.encoder.Encode(manifestHeader{Version: ManifestVersion})
+	if err != nil {
+		return nil, manifest.fail(err)
+	}
+
+	return manifest, nil
+}
+
+// Add writes the entry for a file to the manifest. It is safe to use from several goroutines.
+func (manifest *ManifestWriter) Add(filePath string, entry *ManifestEntry) *Exit {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	if manifest.count > 0 && filePath <= manifest.lastPath {
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: Could not save hashes in %s: %s is not in sorted order", manifest.path, filePath),
+			Code:    ExitcodeHashesMarshal,
+		}
+	}
+	manifest.lastPath = filePath
+	manifest.count++
+
+	err := manifest.encoder.Encode(manifestLine{Path: filePath, ManifestEntry: *entry})
+	if err != nil {
+		return manifest.fail(err)
+	}
+
+	return nil
+}
+
+// Close finishes the manifest and moves it to its final path
+func (manifest *ManifestWriter) Close() *Exit {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	err := manifest.writer.Flush()
+	if err != nil {
+		return manifest.fail(err)
+	}
+
+	if manifest.gzip != nil {
+		err = manifest.gzip.Close()
+		if err != nil {
+			return manifest.fail(err)
+		}
+	}
+
+	err = manifest.cipher.Close()
+	if err != nil {
+		return manifest.fail(err)
+	}
+
+	err = manifest.file.Commit(manifest.sync)
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: Could not save hashes in %s: %s", manifest.path, err.Error()),
+			Code:    ExitcodeHashesWrite,
+		}
+	}
+
+	return nil
+}
+
+// Abort stops writing the manifest and removes the temporary file
+func (manifest *ManifestWriter) Abort() {
+	manifest.file.Abort()
+}
+
+func (manifest *ManifestWriter) fail(err error) *Exit {
+	manifest.Abort()
+	return &Exit{
+		Message: fmt.Sprintf("ERROR: Could not save hashes in %s: %s", manifest.path, err.Error()),
+		Code:    ExitcodeHashesWrite,
+	}
+}
+
+// ManifestReader reads the hashes from a manifest in sorted order. Manifests written by older versions are loaded
+// into memory and sorted, newer ones are read line by line.
+type ManifestReader struct {
+	path    string
+	file    io.ReadCloser
+	reader  *bufio.Reader
+	version int
+
+	legacy      map[string]string
+	legacyPaths []string
+
+	lastPath string
+	count    int
+}
+
+// OpenManifest opens the manifest at the given path of the storage. Compressed and encrypted manifests are detected
+// automatically, encrypted ones are decrypted using the given cipher.
+func OpenManifest(storage Storage, path string, cipher *Cipher) (*ManifestReader, error) {
+	file, err := storage.Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ManifestReader{
+		path:   path,
+		file:   file,
+		reader: bufio.NewReader(file),
+	}
+
+	err = manifest.readHeader(cipher)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (manifest *ManifestReader) readHeader(cipher *Cipher) error {
+	magic, err := manifest.reader.Peek(len(encryptionMagic))
+	if err == nil && isEncrypted(magic) {
+		if cipher == nil {
+			return fmt.Errorf("manifest %s is encrypted, the key is needed to read it", manifest.path)
+		}
+		decrypted, err := cipher.Reader(manifest.reader)
+		if err != nil {
+			return err
+		}
+		manifest.reader = bufio.NewReader(decrypted)
+	}
+
+	magic, err = manifest.reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(manifest.reader)
+		if err != nil {
+			return err
+		}
+		manifest.reader = bufio.NewReader(decompressed)
+	}
+
+	firstLine, err := manifest.reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	header := manifestHeader{}
+	if json.Unmarshal(firstLine, &header) == nil && header.Version >= 2 {
+		if header.Version > ManifestVersion {
+			return fmt.Errorf("manifest version %d is not supported", header.Version)
+		}
+		manifest.version = header.Version
+		return nil
+	}
+
+	// Version 1 is a single JSON object, which has to be loaded completely
+	rest, err := ioutil.ReadAll(manifest.reader)
+	if err != nil {
+		return err
+	}
+
+	manifest.legacy = make(map[string]string)
+	err = json.Unmarshal(append(firstLine, rest...), &manifest.legacy)
+	if err != nil {
+		return err
+	}
+
+	manifest.legacyPaths = make([]string, 0, len(manifest.legacy))
+	for filePath := range manifest.legacy {
+		manifest.legacyPaths = append(manifest.legacyPaths, filePath)
+	}
+	sort.Strings(manifest.legacyPaths)
+	manifest.version = 1
+
+	return nil
+}
+
+// Next returns the next file and its entry. Returns false when there are no more files.
+func (manifest *ManifestReader) Next() (string, *ManifestEntry, bool, error) {
+	if manifest.legacy != nil {
+		if manifest.count >= len(manifest.legacyPaths) {
+			return "", nil, false, nil
+		}
+		filePath := manifest.legacyPaths[manifest.count]
+		manifest.count++
+		return filePath, ParseLegacyEntry(manifest.legacy[filePath]), true, nil
+	}
+
+	for {
+		data, err := manifest.reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return "", nil, false, nil
+		} else if err != nil && err != io.EOF {
+			return "", nil, false, err
+		}
+
+		if len(data) == 0 || (len(data) == 1 && data[0] == '\n') {
+			continue
+		}
+
+		line := manifestLine{}
+		err = json.Unmarshal(data, &line)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("invalid entry in manifest %s: %s", manifest.path, err.Error())
+		}
+
+		if manifest.count > 0 && line.Path <= manifest.lastPath {
+			return "", nil, false, fmt.Errorf("manifest %s is not sorted at %s", manifest.path, line.Path)
+		}
+		manifest.lastPath = line.Path
+		manifest.count++
+
+		if manifest.version == 2 {
+			return line.Path, ParseLegacyEntry(line.Hash), true, nil
+		}
+
+		entry := line.ManifestEntry
+		return line.Path, &entry, true, nil
+	}
+}
+
+// Close closes the underlying file
+func (manifest *ManifestReader) Close() error {
+	return manifest.file.Close()
+}
+
+// ReadManifest reads all entries from the manifest at the given path. Returns false if the manifest does not exist.
+func ReadManifest(storage Storage, path string, cipher *Cipher) (map[string]*ManifestEntry, bool, error) {
+	manifest, err := OpenManifest(storage, path, cipher)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer LogError(manifest.Close)
+
+	entries := make(map[string]*ManifestEntry)
+	for {
+		filePath, entry, ok, err := manifest.Next()
+		if err != nil {
+			return nil, false, err
+		} else if !ok {
+			break
+		}
+		entries[filePath] = entry
+	}
+
+	return entries, true, nil
+}
+
+// ManifestLookup finds the entries of files in a manifest. The files must be looked up in sorted order, so only the
+// current entry of the manifest is kept in memory.
+type ManifestLookup struct {
+	manifest *ManifestReader
+	started  bool
+	done     bool
+	path     string
+	entry    *ManifestEntry
+}
+
+// NewManifestLookup creates a lookup for the given manifest. A nil manifest never contains any files.
+func NewManifestLookup(manifest *ManifestReader) *ManifestLookup {
+	return &ManifestLookup{
+		manifest: manifest,
+		done:     manifest == nil,
+	}
+}
+
+// Find returns the entry for the given path or nil if it is not found in the manifest
+func (lookup *ManifestLookup) Find(filePath string) (*ManifestEntry, error) {
+	for !lookup.done && (!lookup.started || lookup.path < filePath) {
+		lookup.started = true
+
+		var ok bool
+		var err error
+		lookup.path, lookup.entry, ok, err = lookup.manifest.Next()
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			lookup.done = true
+		}
+	}
+
+	if !lookup.done && lookup.path == filePath {
+		return lookup.entry, nil
+	}
+
+	return nil, nil
+}
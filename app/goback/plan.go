@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Plan describes what create will do with the files in the source and the reference
+type Plan struct {
+	Move    []string // Unchanged files that are moved from the reference into the new backup
+	Copy    []string // New and changed files that are copied from the source
+	Changed []string // Files that are copied from the source, but also exist with a different entry in the reference
+	Deleted []string // Files that only exist in the reference and are left behind in it
+	Rename  []string // New files that are moved from a deleted file with the same content in the reference
+
+	RenamedFrom map[string]string // Path in the reference of the renamed files
+
+	MoveBytes    int64
+	CopyBytes    int64
+	DeletedBytes int64
+	RenameBytes  int64
+
+	sizes          map[string]int64
+	renamedDigests map[string]string // Digests of the renamed files
+	rewritten      map[string]bool   // Changed files whose size and modification time both differ from the reference
+}
+
+// createPlan compares the entries of the source with the ones of the reference
+func createPlan(fromHashes, refHashes map[string]*ManifestEntry) *Plan {
+	plan := &Plan{
+		Move:    []string{},
+		Copy:    []string{},
+		Changed: []string{},
+		Deleted: []string{},
+		Rename:  []string{},
+
+		RenamedFrom:    map[string]string{},
+		sizes:          make(map[string]int64, len(fromHashes)),
+		renamedDigests: map[string]string{},
+		rewritten:      map[string]bool{},
+	}
+
+	for filePath, entry := range fromHashes {
+		size := entry.Size
+		plan.sizes[filePath] = size
+
+		refEntry, found := refHashes[filePath]
+		if found && entry.Unchanged(refEntry) {
+			plan.Move = append(plan.Move, filePath)
+			plan.MoveBytes += size
+		} else {
+			plan.Copy = append(plan.Copy, filePath)
+			plan.CopyBytes += size
+			if found {
+				plan.Changed = append(plan.Changed, filePath)
+				if entry.Size != refEntry.Size && entry.ModTime != refEntry.ModTime {
+					plan.rewritten[filePath] = true
+				}
+			}
+		}
+	}
+
+	for filePath, entry := range refHashes {
+		if _, found := fromHashes[filePath]; !found {
+			size := entry.Size
+			plan.sizes[filePath] = size
+			plan.Deleted = append(plan.Deleted, filePath)
+			plan.DeletedBytes += size
+		}
+	}
+
+	sort.Strings(plan.Move)
+	sort.Strings(plan.Copy)
+	sort.Strings(plan.Changed)
+	sort.Strings(plan.Deleted)
+
+	return plan
+}
+
+// ChangeRatio returns the share of files in the reference that will be deleted or changed. Renamed files are neither.
+func (plan *Plan) ChangeRatio() float64 {
+	numReference := len(plan.Move) + len(plan.Changed) + len(plan.Deleted) + len(plan.Rename)
+	if numReference == 0 {
+		return 0
+	}
+
+	return float64(len(plan.Changed)+len(plan.Deleted)) / float64(numReference)
+}
+
+// Print writes the list of files and a summary in a human readable format
+func (plan *Plan) Print(out io.Writer) {
+	plan.printFiles(out, "Moved from last backup", plan.Move)
+	plan.printRenamed(out)
+	plan.printFiles(out, "Copied from source", plan.Copy)
+	plan.printFiles(out, "Left behind as deleted", plan.Deleted)
+
+	_, _ = fmt.Fprintf(out, "Summary:\n")
+	_, _ = fmt.Fprintf(out, "  Moved from last backup: %8d files %12s\n", len(plan.Move), FormatBytes(plan.MoveBytes))
+	_, _ = fmt.Fprintf(out, "  Renamed in last backup: %8d files %12s\n", len(plan.Rename), FormatBytes(plan.RenameBytes))
+	_, _ = fmt.Fprintf(out, "  Copied from source:     %8d files %12s\n", len(plan.Copy), FormatBytes(plan.CopyBytes))
+	_, _ = fmt.Fprintf(out, "  Left behind as deleted: %8d files %12s\n", len(plan.Deleted), FormatBytes(plan.DeletedBytes))
+	_, _ = fmt.Fprintf(out, "  Free space needed:                    %12s\n", FormatBytes(plan.CopyBytes))
+}
+
+func (plan *Plan) printRenamed(out io.Writer) {
+	if len(plan.Rename) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(out, "Renamed in last backup:\n")
+	for _, filePath := range plan.Rename {
+		_, _ = fmt.Fprintf(out, "  %s -> %s (%s)\n", plan.RenamedFrom[filePath], filePath, FormatBytes(plan.sizes[filePath]))
+	}
+	_, _ = fmt.Fprintf(out, "\n")
+}
+
+func (plan *Plan) printFiles(out io.Writer, title string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(out, "%s:\n", title)
+	for _, filePath := range files {
+		_, _ = fmt.Fprintf(out, "  %s (%s)\n", filePath, FormatBytes(plan.sizes[filePath]))
+	}
+	_, _ = fmt.Fprintf(out, "\n")
+}
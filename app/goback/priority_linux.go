@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// I/O scheduling classes and targets of ioprio_set, see linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// nicePriority is the lowest CPU scheduling priority
+const nicePriority = 19
+
+// SetLowPriority lowers the CPU priority and sets the I/O scheduling class to idle, so the backup only uses the disks
+// when nobody else needs them. Both are set per thread on Linux, so all threads of the process are changed. Threads
+// created later inherit the priorities from the thread creating them.
+func SetLowPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 && errno != unix.ESRCH {
+			return errno
+		}
+
+		err = unix.Setpriority(unix.PRIO_PROCESS, tid, nicePriority)
+		if err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// SetLowPriority is only supported on Linux
+func SetLowPriority() error {
+	return errors.New("not supported on this platform")
+}
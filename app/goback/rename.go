@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// renameBlockSize is the size of the first block of the files that is compared before their whole content is hashed
+const renameBlockSize = 4096
+
+// detectRenames finds new files in the source that have the same size and content as files that were deleted from the
+// reference. These files are moved from their old path in the reference instead of copying them from the source. The
+// first blocks are compared before a file is read completely, and all reads are limited by the throttle. The digests of
+// the renamed files are stored in the plan. The reference is read from the storage and its encrypted files are
+// decrypted using the given cipher.
+func (plan *Plan) detectRenames(storage Storage, from, ref string, fromHashes, refHashes map[string]*ManifestEntry, cipher *Cipher, throttle *Throttle) {
+	// Deleted files by size, only regular files with content can be matched reliably
+	candidates := map[int64][]string{}
+	for _, filePath := range plan.Deleted {
+		entry := refHashes[filePath]
+		if entry.Type == EntryTypeFile && entry.Size > 0 && !entry.Inconsistent {
+			candidates[entry.Size] = append(candidates[entry.Size], filePath)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	changed := make(map[string]bool, len(plan.Changed))
+	for _, filePath := range plan.Changed {
+		changed[filePath] = true
+	}
+
+	refHeads := map[string][]byte{}
+	refHead := func(filePath string) []byte {
+		head, found := refHeads[filePath]
+		if !found {
+			var err error
+			head, err = storageHead(storage, filepath.Join(ref, cipher.Path(filePath)), cipher, throttle)
+			if err != nil {
+				Log.F(OutputLevelWarning, "Could not read %s in last backup: %s", filePath, err.Error())
+			}
+			refHeads[filePath] = head
+		}
+		return head
+	}
+
+	refDigests := map[string]string{}
+	refDigest := func(filePath string) string {
+		digest, found := refDigests[filePath]
+		if !found {
+			digest = refHashes[filePath].Digest
+			if digest == "" {
+				throttle.WaitFile()
+				data, err := throttledDigest(storage, filepath.Join(ref, cipher.Path(filePath)), cipher, throttle)
+				if err != nil {
+					Log.F(OutputLevelWarning, "Could not read %s in last backup: %s", filePath, err.Error())
+				} else {
+					digest = hex.EncodeToString(data)
+				}
+			}
+			refDigests[filePath] = digest
+		}
+		return digest
+	}
+
+	renamed := map[string]bool{}
+	for _, filePath := range plan.Copy {
+		entry := fromHashes[filePath]
+		if changed[filePath] || entry.Type != EntryTypeFile || len(candidates[entry.Size]) == 0 {
+			continue
+		}
+
+		head, digest, err := matchRename(filepath.Join(from, filePath), candidates[entry.Size], refHead, throttle)
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not read %s: %s", filePath, err.Error())
+			continue
+		} else if digest == "" {
+			continue
+		}
+
+		remaining := candidates[entry.Size]
+		for i, oldPath := range remaining {
+			if bytes.Equal(refHead(oldPath), head) && refDigest(oldPath) == digest {
+				plan.RenamedFrom[filePath] = oldPath
+				plan.renamedDigests[filePath] = digest
+				renamed[filePath] = true
+				renamed[oldPath] = true
+				candidates[entry.Size] = append(remaining[:i:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(renamed) == 0 {
+		return
+	}
+
+	plan.Copy = withoutFiles(plan.Copy, renamed)
+	plan.Deleted = withoutFiles(plan.Deleted, renamed)
+	for filePath, oldPath := range plan.RenamedFrom {
+		plan.Rename = append(plan.Rename, filePath)
+		plan.RenameBytes += plan.sizes[filePath]
+		plan.CopyBytes -= plan.sizes[filePath]
+		plan.DeletedBytes -= plan.sizes[oldPath]
+	}
+	sort.Strings(plan.Rename)
+}
+
+// matchRename reads the first block of the source file and returns it with the digest of the content if the block
+// equals the first block of one of the candidates. Returns an empty digest if no candidate can match.
+func matchRename(path string, candidates []string, refHead func(string) []byte, throttle *Throttle) ([]byte, string, error) {
+	throttle.WaitFile()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer LogError(file.Close)
+
+	reader := throttle.Reader(file)
+	head, err := readHead(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	match := false
+	for _, oldPath := range candidates {
+		if bytes.Equal(refHead(oldPath), head) {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return head, "", nil
+	}
+
+	hash := sha256.New()
+	_, _ = hash.Write(head)
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return head, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// storageHead returns the first block of the given file in the storage. Encrypted files are decrypted using the given
+// cipher.
+func storageHead(storage Storage, path string, cipher *Cipher, throttle *Throttle) ([]byte, error) {
+	throttle.WaitFile()
+	file, err := storage.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	defer LogError(file.Close)
+
+	reader, err := cipher.Reader(throttle.Reader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	return readHead(reader)
+}
+
+// throttledDigest returns the SHA-256 digest of the given file in the storage like storageDigest, reading it within
+// the limits of the throttle
+func throttledDigest(storage Storage, path string, cipher *Cipher, throttle *Throttle) ([]byte, error) {
+	file, err := storage.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	defer LogError(file.Close)
+
+	return readDigest(throttle.Reader(file), cipher)
+}
+
+// readHead reads the first block of data. Shorter data is returned completely.
+func readHead(reader io.Reader) ([]byte, error) {
+	head := make([]byte, renameBlockSize)
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return head[:n], err
+}
+
+// renamed returns the path in the reference the given file was renamed from and the digest of its content
+func (plan *Plan) renamed(filePath string) (string, string, bool) {
+	if plan == nil {
+		return "", "", false
+	}
+	oldPath, found := plan.RenamedFrom[filePath]
+	return oldPath, plan.renamedDigests[filePath], found
+}
+
+// withoutFiles returns the files that are not contained in the given set
+func withoutFiles(files []string, remove map[string]bool) []string {
+	result := make([]string, 0, len(files))
+	for _, filePath := range files {
+		if !remove[filePath] {
+			result = append(result, filePath)
+		}
+	}
+	return result
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RestoreLatest restores the latest backup
+const RestoreLatest = "latest"
+
+// Restore contains the information needed to restore a backup
+type Restore struct {
+	Target      string   // Directory containing the backups
+	Destination string   // Directory to restore into
+	Snapshots   []string // Names of the backups from the oldest to the latest
+	Cipher      *Cipher  // Decrypts the backups if the target is encrypted
+	Storage     Storage  // Storage of the target
+
+	renames map[int]map[string]string // New path by old path of the files renamed in a backup, read when needed
+	codecs  map[int]map[string]string // Codec by path of the files compressed in a backup, read when needed
+	coded   map[int]map[string]bool   // Paths in a backup ending with the extension of a codec, read when needed
+}
+
+// listSnapshots returns the names of the backups in the target directory in the storage from the oldest to the latest.
+// The names are timestamps, so they sort in the order the backups were created. Quarantined backups are not part of the
+// history.
+func listSnapshots(storage Storage, target string) ([]string, error) {
+	files, err := storage.List(target)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []string{}
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() || strings.HasSuffix(name, QuarantineSuffix) {
+			continue
+		}
+		if _, err := storage.Stat(filepath.Join(target, name+"."+HashesExtension)); err == nil {
+			snapshots = append(snapshots, name)
+		}
+	}
+	sort.Strings(snapshots)
+
+	return snapshots, nil
+}
+
+func restore(args *Arguments) *Exit {
+	if args.RestoreTo == "" {
+		return &Exit{
+			Message: "The directory to restore into must be given using -restore-to",
+			Code:    ExitcodeRestore,
+		}
+	}
+
+	restore, index, exit := openSnapshot(args, args.Restore)
+	if exit != nil {
+		return exit
+	}
+	restore.Destination = args.RestoreTo
+
+	return restore.snapshot(index)
+}
+
+func verifyBackup(args *Arguments) *Exit {
+	restore, index, exit := openSnapshot(args, args.VerifyBackup)
+	if exit != nil {
+		return exit
+	}
+
+	return restore.verify(index)
+}
+
+// openSnapshot finds the backup with the given name in the target directory and returns its index in the history. The
+// key of an encrypted target is derived from the arguments.
+func openSnapshot(args *Arguments, name string) (*Restore, int, *Exit) {
+	restore, exit := openTarget(args)
+	if exit != nil {
+		return nil, 0, exit
+	}
+
+	if name == RestoreLatest && len(restore.Snapshots) > 0 {
+		name = restore.Snapshots[len(restore.Snapshots)-1]
+	}
+
+	if strings.HasSuffix(name, QuarantineSuffix) && storageDirectoryExists(restore.Storage, filepath.Join(restore.Target, name)) {
+		// Quarantined backups are complete
+		restore.Snapshots = []string{name}
+	}
+
+	for index, snapshot := range restore.Snapshots {
+		if snapshot == name {
+			return restore, index, nil
+		}
+	}
+
+	return nil, 0, &Exit{
+		Message: fmt.Sprintf("ERROR: Backup %s does not exist in %s", name, restore.Target),
+		Code:    ExitcodeRestore,
+	}
+}
+
+// openTarget lists the backups in the target directory and reads its configuration for the key of an encrypted target
+func openTarget(args *Arguments) (*Restore, *Exit) {
+	config := &Configuration{}
+	storage, location, exit := OpenStorage(args.Target, args)
+	if exit == nil {
+		exit, _ = config.load(storage, location, args)
+	}
+	if exit != nil {
+		return nil, &Exit{
+			Message: "ERROR: " + exit.Message,
+			Code:    ExitcodeRestore,
+		}
+	}
+
+	snapshots, err := listSnapshots(storage, location)
+	if err != nil {
+		return nil, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not read backups in %s: %s", location, err.Error()),
+			Code:    ExitcodeRestore,
+		}
+	}
+
+	return &Restore{
+		Target:    location,
+		Snapshots: snapshots,
+		Cipher:    config.cipher,
+		Storage:   storage,
+	}, nil
+}
+
+// hashes reads the hashes of the backup with the given index
+func (restore *Restore) hashes(index int) (map[string]*ManifestEntry, *Exit) {
+	name := restore.Snapshots[index]
+	hashes, found, err := ReadManifest(restore.Storage, filepath.Join(restore.Target, name+"."+HashesExtension), restore.Cipher)
+	if err != nil || !found {
+		return nil, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not read hashes of backup %s", name),
+			Code:    ExitcodeRestore,
+		}
+	}
+
+	return hashes, nil
+}
+
+// snapshot restores all files of the backup with the given index into the destination
+func (restore *Restore) snapshot(index int) *Exit {
+	name := restore.Snapshots[index]
+	hashes, exit := restore.hashes(index)
+	if exit != nil {
+		return exit
+	}
+
+	files, err := ioutil.ReadDir(restore.Destination)
+	if err == nil && len(files) > 0 {
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: The directory to restore into is not empty: %s", restore.Destination),
+			Code:    ExitcodeRestore,
+		}
+	}
+
+	Log.F(OutputLevelInfo, "Restoring %d files of backup %s into %s", len(hashes), name, restore.Destination)
+	Log.ProgressMax = float64(len(hashes))
+	for _, filePath := range sortedKeys(hashes) {
+		Log.F(OutputLevelDebug, "Restoring: %s", filePath)
+		Log.Step()
+
+		destination := filepath.Join(restore.Destination, filePath)
+		err := os.MkdirAll(filepath.Dir(destination), os.ModePerm)
+		if err == nil {
+			err = restore.file(index, filePath, destination)
+		}
+		if err == nil {
+			err = restoreMetadata(destination, hashes[filePath])
+		}
+		if err != nil {
+			return &Exit{
+				Message: fmt.Sprintf("ERROR: Could not restore %s: %s", filePath, err.Error()),
+				Code:    ExitcodeRestore,
+			}
+		}
+	}
+
+	return nil
+}
+
+// verify reconstructs all files of the backup with the given index and compares them with their entries
+func (restore *Restore) verify(index int) *Exit {
+	name := restore.Snapshots[index]
+	hashes, exit := restore.hashes(index)
+	if exit != nil {
+		return exit
+	}
+
+	tmpDir, err := ioutil.TempDir("", "goback")
+	if err != nil {
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: Could not create temporary directory: %s", err.Error()),
+			Code:    ExitcodeVerify,
+		}
+	}
+	defer LogError(func() error { return os.RemoveAll(tmpDir) })
+
+	Log.F(OutputLevelInfo, "Verifying %d files of backup %s", len(hashes), name)
+	Log.ProgressMax = float64(len(hashes))
+	failed := 0
+	for _, filePath := range sortedKeys(hashes) {
+		Log.Step()
+
+		err := restore.verifyFile(index, filePath, hashes[filePath], filepath.Join(tmpDir, "file"))
+		if err != nil {
+			Log.F(OutputLevelError, "%s: %s", filePath, err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return &Exit{
+			Message: fmt.Sprintf("ERROR: %d of %d files in backup %s are missing or corrupt", failed, len(hashes), name),
+			Code:    ExitcodeVerify,
+		}
+	}
+	Log.F(OutputLevelInfo, "All %d files in backup %s are intact", len(hashes), name)
+
+	return nil
+}
+
+// verifyFile reconstructs a file and compares its size and, if known, its digest with the entry
+func (restore *Restore) verifyFile(index int, filePath string, entry *ManifestEntry, tmpPath string) error {
+	path, cleanup, err := restore.find(index, filePath, tmpPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if entry.Type == EntryTypeFile && !entry.Inconsistent && info.Size() != entry.Size {
+		return fmt.Errorf("size is %d instead of %d", info.Size(), entry.Size)
+	}
+
+	if entry.Digest != "" {
+		digest, err := fileDigest(path, nil)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(digest) != entry.Digest {
+			return fmt.Errorf("content differs from the digest %s", entry.Digest)
+		}
+	}
+
+	return nil
+}
+
+// file reconstructs the version of a file in the backup with the given index. Unchanged files were moved into newer
+// backups, older versions may be stored as deltas against the version in the next newer backup and files in older
+// backups may be compressed.
+func (restore *Restore) file(index int, filePath, destination string) error {
+	basePath, cleanup, err := restore.find(index, filePath, destination)
+	if err != nil {
+		return err
+	} else if basePath == destination {
+		// Reconstructed from a delta
+		return nil
+	}
+	defer cleanup()
+
+	_, exit := CopyFile(basePath, destination, nil)
+	if exit != nil {
+		return fmt.Errorf("%s", exit.Message)
+	}
+
+	return nil
+}
+
+// find returns the path of a local file containing the version in the backup with the given index. Versions that are
+// stored as deltas, compressed, encrypted or in a storage other than the local filesystem are reconstructed into the
+// given temporary path. The returned function removes
+// temporary files that are not needed anymore.
+func (restore *Restore) find(index int, filePath, tmpPath string) (string, func(), error) {
+	noCleanup := func() {}
+	if index >= len(restore.Snapshots) {
+		return "", noCleanup, fmt.Errorf("the newer version of a delta is missing")
+	}
+	name := restore.Snapshots[index]
+
+	for ; index < len(restore.Snapshots); index++ {
+		path := filepath.Join(restore.Target, restore.Snapshots[index], restore.Cipher.Path(filePath))
+
+		if info, err := restore.Storage.Stat(path); err == nil && !info.IsDir() {
+			if restore.Cipher == nil && isLocal(restore.Storage) {
+				return path, noCleanup, nil
+			}
+			err = readStorageFile(restore.Storage, path, tmpPath, restore.Cipher, nil)
+			if err != nil {
+				return "", noCleanup, err
+			}
+			return tmpPath, func() { _ = os.Remove(tmpPath) }, nil
+		}
+
+		if codec, err := restore.compressed(index, filePath, path); err != nil {
+			return "", noCleanup, err
+		} else if codec != nil {
+			err := readStorageFile(restore.Storage, path+codec.Extension, tmpPath, restore.Cipher, codec)
+			if err != nil {
+				return "", noCleanup, err
+			}
+			return tmpPath, func() { _ = os.Remove(tmpPath) }, nil
+		}
+
+		if _, err := restore.Storage.Stat(path + DeltaExtension); err == nil {
+			basePath, cleanup, err := restore.find(index+1, filePath, tmpPath+".base")
+			if err != nil {
+				return "", noCleanup, err
+			}
+			err = applyDelta(restore.Storage, path+DeltaExtension, basePath, tmpPath, restore.Cipher)
+			cleanup()
+			if err != nil {
+				_ = os.Remove(tmpPath)
+				return "", noCleanup, err
+			}
+			return tmpPath, func() { _ = os.Remove(tmpPath) }, nil
+		}
+
+		// Files renamed in the source were moved to their new path in the next backup
+		if index+1 < len(restore.Snapshots) {
+			if newPath := restore.renamedTo(index+1, filePath); newPath != "" {
+				filePath = newPath
+			}
+		}
+	}
+
+	return "", noCleanup, fmt.Errorf("not found in %s or any newer backup", name)
+}
+
+// renamedTo returns the path a file was renamed to in the backup with the given index or an empty string
+func (restore *Restore) renamedTo(index int, filePath string) string {
+	restore.readEntries(index)
+	return restore.renames[index][filePath]
+}
+
+// compressed returns the codec a file at the given path is compressed with in the backup with the given index or nil.
+// Files compressed by a backup that was interrupted before recording the codec are found by the extensions of the
+// registered codecs, unless another file of the backup has that name.
+func (restore *Restore) compressed(index int, filePath, path string) (*Codec, error) {
+	restore.readEntries(index)
+
+	if codecName := restore.codecs[index][filePath]; codecName != "" {
+		codec := Codecs[codecName]
+		if codec == nil {
+			return nil, fmt.Errorf("unknown codec %s", codecName)
+		}
+		return codec, nil
+	}
+
+	for _, codecName := range codecNames() {
+		codec := Codecs[codecName]
+		if restore.coded[index][filePath+codec.Extension] {
+			continue
+		}
+		if _, err := restore.Storage.Stat(path + codec.Extension); err == nil {
+			return codec, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// readEntries reads the renamed and compressed files of the backup with the given index, unless they are known already
+func (restore *Restore) readEntries(index int) {
+	if restore.renames == nil {
+		restore.renames = map[int]map[string]string{}
+		restore.codecs = map[int]map[string]string{}
+		restore.coded = map[int]map[string]bool{}
+	}
+	if _, found := restore.renames[index]; found {
+		return
+	}
+
+	renames := map[string]string{}
+	codecs := map[string]string{}
+	coded := map[string]bool{}
+	hashes, exit := restore.hashes(index)
+	if exit != nil {
+		Log.F(OutputLevelWarning, exit.Message)
+	}
+	for filePath, entry := range hashes {
+		if entry.RenamedFrom != "" {
+			renames[entry.RenamedFrom] = filePath
+		}
+		if entry.Codec != "" {
+			codecs[filePath] = entry.Codec
+		}
+		for _, codec := range Codecs {
+			if strings.HasSuffix(filePath, codec.Extension) {
+				coded[filePath] = true
+			}
+		}
+	}
+	restore.renames[index] = renames
+	restore.codecs[index] = codecs
+	restore.coded[index] = coded
+}
+
+// restoreMetadata sets the permissions and the modification time recorded in the entry
+func restoreMetadata(path string, entry *ManifestEntry) error {
+	if entry.Mode != 0 {
+		err := os.Chmod(path, entry.Mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	modTime := time.Unix(0, entry.ModTime)
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Space describes the free space on a filesystem
+type Space struct {
+	Bytes     uint64 // Free bytes available to unprivileged users
+	Inodes    uint64 // Free inodes available to unprivileged users
+	BlockSize int64  // Size of the allocation unit
+	NoInodes  bool   // Whether the filesystem does not have a fixed number of inodes
+}
+
+// checkSpace compares the space needed for copying the new and changed files to the free space on the target
+func checkSpace(plan *Plan, space *Space) *Exit {
+	if space == nil {
+		return nil
+	}
+
+	bytes := plan.CopyDiskUsage(space.BlockSize)
+	if bytes > space.Bytes {
+		return &Exit{
+			Message: fmt.Sprintf("Not enough free space on target. Needed: %s, available: %s", FormatBytes(int64(bytes)), FormatBytes(int64(space.Bytes))),
+			Code:    ExitcodeNoSpace,
+		}
+	}
+
+	if !space.NoInodes {
+		inodes := plan.Inodes()
+		if inodes > space.Inodes {
+			return &Exit{
+				Message: fmt.Sprintf("Not enough free inodes on target. Needed: %d, available: %d", inodes, space.Inodes),
+				Code:    ExitcodeNoSpace,
+			}
+		}
+	}
+
+	return nil
+}
+
+// CopyDiskUsage estimates the space used by the copied files in case they are stored in blocks of the given size
+func (plan *Plan) CopyDiskUsage(blockSize int64) uint64 {
+	if blockSize < 1 {
+		return uint64(plan.CopyBytes)
+	}
+
+	var usage uint64
+	for _, filePath := range plan.Copy {
+		blocks := (plan.sizes[filePath] + blockSize - 1) / blockSize
+		usage += uint64(blocks * blockSize)
+	}
+
+	return usage
+}
+
+// Inodes estimates the number of inodes needed for the new backup. Moved files keep their inode, but every directory
+// is created again.
+func (plan *Plan) Inodes() uint64 {
+	directories := map[string]bool{}
+	for _, files := range [][]string{plan.Move, plan.Rename, plan.Copy} {
+		for _, filePath := range files {
+			for dir := path.Dir(filePath); dir != "." && !directories[dir]; dir = path.Dir(dir) {
+				directories[dir] = true
+			}
+		}
+	}
+
+	// The backup directory and the file containing the hashes
+	return uint64(len(plan.Copy)+len(directories)) + 2
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the free space on the filesystem of the given directory
+func FreeSpace(directory string) (*Space, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(directory, &fs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The block counts are given in units of the fragment size
+	blockSize := int64(fs.Frsize)
+	if blockSize == 0 {
+		blockSize = int64(fs.Bsize)
+	}
+
+	return &Space{
+		Bytes:     fs.Bavail * uint64(blockSize),
+		Inodes:    fs.Ffree,
+		BlockSize: blockSize,
+		NoInodes:  fs.Files == 0, // btrfs and others allocate inodes dynamically
+	}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// FreeSpace is not supported on this platform, the check is skipped
+func FreeSpace(directory string) (*Space, error) {
+	return nil, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Methods used for copying files
+const (
+	CopyMethodReflink       = "reflink"
+	CopyMethodCopyFileRange = "copy_file_range"
+	CopyMethodCopy          = "copy"
+	CopyMethodVerified      = "verified copy"
+	CopyMethodEncrypted     = "encrypted copy"
+)
+
+// Statistics collects information about a backup run. It is safe to use from several goroutines.
+type Statistics struct {
+	Moved        int
+	MovedBytes   int64
+	Copied       int
+	CopiedBytes  int64
+	CopyMethods  map[string]int
+	Skipped      int
+	Renamed      int
+	RenamedBytes int64
+	Linked       int
+	LinkedBytes  int64
+	// Inconsistent contains the files that changed while they were copied
+	Inconsistent []string
+
+	start time.Time
+	mutex sync.Mutex
+}
+
+// Start starts measuring the duration of the backup
+func (stats *Statistics) Start() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.start = time.Now()
+}
+
+// AddMove records a file moved from the reference
+func (stats *Statistics) AddMove(bytes int64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Moved++
+	stats.MovedBytes += bytes
+}
+
+// AddCopy records a file copied from the source using the given method
+func (stats *Statistics) AddCopy(method string, bytes int64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if stats.CopyMethods == nil {
+		stats.CopyMethods = make(map[string]int)
+	}
+
+	stats.Copied++
+	stats.CopiedBytes += bytes
+	stats.CopyMethods[method]++
+}
+
+// AddRename records a file moved from another path in the reference
+func (stats *Statistics) AddRename(bytes int64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Renamed++
+	stats.RenamedBytes += bytes
+}
+
+// AddLink records a file linked from a file with the same content instead of copying it
+func (stats *Statistics) AddLink(bytes int64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Linked++
+	stats.LinkedBytes += bytes
+}
+
+// AddSkip records a file that already existed in the backup
+func (stats *Statistics) AddSkip() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Skipped++
+}
+
+// AddInconsistent records a file that kept changing while it was copied
+func (stats *Statistics) AddInconsistent(filePath string) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.Inconsistent = append(stats.Inconsistent, filePath)
+}
+
+// Log writes a summary of the backup
+func (stats *Statistics) Log() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	duration := time.Since(stats.start)
+
+	methods := make([]string, 0, len(stats.CopyMethods))
+	for method, count := range stats.CopyMethods {
+		methods = append(methods, fmt.Sprintf("%s: %d", method, count))
+	}
+	sort.Strings(methods)
+
+	speed := ""
+	if seconds := duration.Seconds(); seconds > 0 {
+		speed = fmt.Sprintf(" (%s/s)", FormatBytes(int64(float64(stats.CopiedBytes)/seconds)))
+	}
+
+	Log.F(OutputLevelInfo, "Moved %d files (%s) from last backup", stats.Moved, FormatBytes(stats.MovedBytes))
+	if stats.Renamed > 0 {
+		Log.F(OutputLevelInfo, "Moved %d renamed files (%s) from last backup", stats.Renamed, FormatBytes(stats.RenamedBytes))
+	}
+	Log.F(OutputLevelInfo, "Copied %d files (%s) from source%s", stats.Copied, FormatBytes(stats.CopiedBytes), speed)
+	if stats.Linked > 0 {
+		Log.F(OutputLevelInfo, "Linked %d duplicate files (%s) instead of copying them", stats.Linked, FormatBytes(stats.LinkedBytes))
+	}
+	if len(methods) > 0 {
+		Log.F(OutputLevelInfo, "Copy methods used: %s", strings.Join(methods, ", "))
+	}
+	if stats.Skipped > 0 {
+		Log.F(OutputLevelInfo, "Skipped %d files already in backup", stats.Skipped)
+	}
+	if len(stats.Inconsistent) > 0 {
+		sort.Strings(stats.Inconsistent)
+		Log.F(OutputLevelWarning, "%d files changed while they were copied and may be inconsistent in the backup:", len(stats.Inconsistent))
+		for _, filePath := range stats.Inconsistent {
+			Log.F(OutputLevelWarning, "  %s", filePath)
+		}
+	}
+	Log.F(OutputLevelInfo, "Backup took %s", duration.Round(time.Millisecond))
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage stores the backups in the target. Paths are the location of the target joined with the path of a file
+// inside it, so they can be logged as they are. Implementations other than the local filesystem map them to their own
+// names. Missing files are reported using errors for which os.IsNotExist returns true.
+type Storage interface {
+	// Stat returns the information about a file or directory
+	Stat(path string) (os.FileInfo, error)
+	// List returns the files and directories in a directory sorted by name
+	List(dir string) ([]os.FileInfo, error)
+	// Read opens a file for reading
+	Read(path string) (io.ReadCloser, error)
+	// Put creates a file, which only becomes visible when it is committed. Missing directories are created.
+	Put(path string) (StorageFile, error)
+	// Move renames a file. Missing directories are created.
+	Move(source, destination string, options *CopyOptions) error
+	// Delete removes a file or an empty directory
+	Delete(path string) error
+	// Mkdir creates a directory and its parents
+	Mkdir(path string) error
+}
+
+// StorageFile is a file that is being written to a storage
+type StorageFile interface {
+	io.Writer
+	// Commit finishes the file and puts it in place, replacing an existing one. If sync is set, the file is flushed to
+	// stable storage if the storage supports it.
+	Commit(sync bool) error
+	// Abort discards the file
+	Abort()
+}
+
+// storageLinker is implemented by storages that can hard-link files
+type storageLinker interface {
+	Link(source, destination string, options *CopyOptions) error
+}
+
+// storageCopier is implemented by storages that copy files from the local filesystem faster than writing their data
+type storageCopier interface {
+	CopyFile(source, destination string, options *CopyOptions) (string, *Exit)
+}
+
+// storageSizer is implemented by storages that need to know the size of a file before it is written
+type storageSizer interface {
+	PutSize(path string, size int64) (StorageFile, error)
+}
+
+// StorageSchemes creates the storages for targets given as URL by their scheme. Targets without a scheme are local
+// directories. Other storages can be registered here.
+var StorageSchemes = map[string]func(target *url.URL, args *Arguments) (Storage, string, error){
+	"s3":      openS3Storage,
+	"sftp":    openSFTPStorage,
+	"webdav":  openWebDAVStorage,
+	"webdavs": openWebDAVStorage,
+}
+
+// Timeouts of the connections to storages reached using HTTP. There is no timeout for a whole request, as uploads of
+// large files take as long as they take.
+const (
+	HTTPDialTimeout           = 30 * time.Second
+	HTTPResponseHeaderTimeout = 5 * time.Minute // The server may take a while to assemble an upload before answering
+)
+
+// newHTTPClient returns a client for storages reached using HTTP that gives up on servers that cannot be reached or
+// stop answering
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   HTTPDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = HTTPResponseHeaderTimeout
+
+	return &http.Client{Transport: transport}
+}
+
+// OpenStorage opens the storage of the given target and returns it with the location of the target in it
+func OpenStorage(target string, args *Arguments) (Storage, string, *Exit) {
+	if scheme := strings.SplitN(target, "://", 2); len(scheme) == 2 {
+		open, found := StorageSchemes[scheme[0]]
+		if !found {
+			return nil, "", &Exit{
+				Code:    ExitCodeConfiguration,
+				Message: fmt.Sprintf("Targets of type %s are not supported", scheme[0]),
+			}
+		}
+
+		targetURL, err := url.Parse(target)
+		var storage Storage
+		var location string
+		if err == nil {
+			storage, location, err = open(targetURL, args)
+		}
+		if err != nil {
+			return nil, "", &Exit{
+				Code:    ExitCodeConfiguration,
+				Message: fmt.Sprintf("Could not open %s target: %s", scheme[0], err.Error()),
+			}
+		}
+		return storage, location, nil
+	}
+
+	location, err := filepath.Abs(target)
+	if err != nil {
+		return nil, "", &Exit{
+			Code:    ExitCodeConfiguration,
+			Message: "Target directory is not valid",
+		}
+	}
+
+	return &LocalStorage{}, location, nil
+}
+
+// isLocal returns true if the storage is the local filesystem
+func isLocal(storage Storage) bool {
+	_, local := storage.(*LocalStorage)
+	return local
+}
+
+// storageDirectoryExists returns true if the given path exists in the storage and is a directory
+func storageDirectoryExists(storage Storage, path string) bool {
+	info, err := storage.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log.F(OutputLevelError, "Error checking for directory %s: %s", path, err.Error())
+		}
+		return false
+	}
+
+	return info.IsDir()
+}
+
+// storeFile copies a file from the local filesystem into the storage like CopyFile. Storages that cannot copy files
+// themselves get the data written through the cipher and the throttle.
+func storeFile(storage Storage, source, destination string, options *CopyOptions) (string, *Exit) {
+	if copier, ok := storage.(storageCopier); ok {
+		return copier.CopyFile(source, destination, options)
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return "", &Exit{
+			Message: fmt.Sprintf("Opening %s: %s", source, err.Error()),
+			Code:    ExitcodeCopyRead,
+		}
+	}
+	defer LogError(in.Close)
+
+	var out StorageFile
+	info, err := in.Stat()
+	if sizer, ok := storage.(storageSizer); ok && err == nil {
+		out, err = sizer.PutSize(destination, options.cipher().Size(info.Size()))
+	} else {
+		out, err = storage.Put(destination)
+	}
+	if err != nil {
+		return "", &Exit{
+			Message: fmt.Sprintf("Creating file %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyCreate,
+		}
+	}
+
+	method := CopyMethodCopy
+	if options.cipher() != nil {
+		method = CopyMethodEncrypted
+	}
+	hash := sha256.New()
+	writer, err := options.cipher().Writer(out)
+	var size int64
+	if err == nil {
+		size, err = io.Copy(io.MultiWriter(writer, hash), options.throttle().Reader(in))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		out.Abort()
+		return "", &Exit{
+			Message: fmt.Sprintf("Writing to %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyWrite,
+		}
+	}
+
+	digest := hash.Sum(nil)
+	if options.duplicate(digest, size, destination) {
+		out.Abort()
+		return hex.EncodeToString(digest), nil
+	}
+
+	err = out.Commit(options.syncFiles())
+	if err != nil {
+		return "", &Exit{
+			Message: fmt.Sprintf("Closing %s: %s", destination, err.Error()),
+			Code:    ExitcodeCopyClose,
+		}
+	}
+
+	if options.verify() {
+		method = CopyMethodVerified
+		stored, err := storageDigest(storage, destination, options.cipher())
+		if err != nil || !bytes.Equal(stored, digest) {
+			_ = storage.Delete(destination)
+			return "", &Exit{
+				Message: fmt.Sprintf("Verifying %s: The data written differs from the source", destination),
+				Code:    ExitcodeCopyVerify,
+			}
+		}
+	}
+
+	if options != nil && options.Statistics != nil {
+		options.Statistics.AddCopy(method, size)
+	}
+
+	return hex.EncodeToString(digest), nil
+}
+
+// storageDigest returns the SHA-256 digest of the content of the given file in the storage. Encrypted files are
+// decrypted using the given cipher.
+func storageDigest(storage Storage, path string, cipher *Cipher) ([]byte, error) {
+	file, err := storage.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	defer LogError(file.Close)
+
+	return readDigest(file, cipher)
+}
+
+// readStorageFile writes the content of the given file in the storage to the destination. Encrypted files are decrypted
+// using the given cipher and compressed files are decompressed using the given codec, if any.
+func readStorageFile(storage Storage, path, destination string, cipher *Cipher, codec *Codec) error {
+	in, err := storage.Read(path)
+	if err != nil {
+		return err
+	}
+	defer LogError(in.Close)
+
+	reader, err := cipher.Reader(in)
+	if err != nil {
+		return err
+	}
+	if codec != nil {
+		decompressed, err := codec.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer LogError(decompressed.Close)
+		reader = decompressed
+	}
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, reader)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(destination)
+	}
+
+	return err
+}
+
+// storageFileInfo describes a file in a storage other than the local filesystem
+type storageFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (info *storageFileInfo) Name() string       { return info.name }
+func (info *storageFileInfo) Size() int64        { return info.size }
+func (info *storageFileInfo) ModTime() time.Time { return info.modTime }
+func (info *storageFileInfo) IsDir() bool        { return info.dir }
+func (info *storageFileInfo) Sys() interface{}   { return nil }
+
+func (info *storageFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// sortFileInfos sorts the entries of a directory by name
+func sortFileInfos(files []os.FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LocalStorage stores the backups in a directory of the local filesystem. Paths are the paths of the files.
+type LocalStorage struct{}
+
+// Stat returns the information about a file without following symlinks
+func (*LocalStorage) Stat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+// List returns the entries of the directory sorted by name
+func (*LocalStorage) List(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+// Read opens the file for reading
+func (*LocalStorage) Read(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// Put writes a temporary file next to the given path, which is renamed on commit
+func (*LocalStorage) Put(path string) (StorageFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path + ".part")
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFile{File: file, path: path}, nil
+}
+
+// Move renames the file, across devices if needed
+func (*LocalStorage) Move(source, destination string, options *CopyOptions) error {
+	exit := MoveFile(source, destination, options)
+	if exit != nil {
+		return errors.New(exit.Message)
+	}
+	return nil
+}
+
+// Delete removes the file or empty directory
+func (*LocalStorage) Delete(path string) error {
+	return os.Remove(path)
+}
+
+// Mkdir creates the directory and its parents
+func (*LocalStorage) Mkdir(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+// Link creates a hard link
+func (*LocalStorage) Link(source, destination string, options *CopyOptions) error {
+	exit := LinkFile(source, destination, options)
+	if exit != nil {
+		return errors.New(exit.Message)
+	}
+	return nil
+}
+
+// CopyFile copies the file using the fastest method available
+func (*LocalStorage) CopyFile(source, destination string, options *CopyOptions) (string, *Exit) {
+	return CopyFile(source, destination, options)
+}
+
+// localFile is a temporary file that replaces the file at path on commit
+type localFile struct {
+	*os.File
+	path string
+}
+
+func (file *localFile) Commit(sync bool) error {
+	var err error
+	if sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	err = os.Rename(file.Name(), file.path)
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+
+	if sync {
+		return SyncDirectory(filepath.Dir(file.path))
+	}
+
+	return nil
+}
+
+func (file *localFile) Abort() {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps the backups in memory. It is meant for tests. Directories exist if they were created or contain
+// files. Hard links share the content of the file.
+type MemoryStorage struct {
+	files map[string]*memoryFile
+	dirs  map[string]bool
+	mutex sync.Mutex
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage creates an empty storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: map[string]*memoryFile{},
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+// memoryPath normalizes a path, so every file has exactly one
+func memoryPath(filePath string) string {
+	return path.Clean("/" + filepath.ToSlash(filePath))
+}
+
+func notExist(op, filePath string) error {
+	return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+}
+
+// Stat returns the information about a file or directory
+func (storage *MemoryStorage) Stat(filePath string) (os.FileInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	key := memoryPath(filePath)
+	if file, found := storage.files[key]; found {
+		return &storageFileInfo{name: path.Base(key), size: int64(len(file.data)), modTime: file.modTime}, nil
+	}
+	if storage.isDir(key) {
+		return &storageFileInfo{name: path.Base(key), dir: true}, nil
+	}
+
+	return nil, notExist("stat", filePath)
+}
+
+// List returns the files and directories in the directory sorted by name
+func (storage *MemoryStorage) List(dir string) ([]os.FileInfo, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	key := memoryPath(dir)
+	if !storage.isDir(key) {
+		return nil, notExist("list", dir)
+	}
+
+	entries := map[string]os.FileInfo{}
+	addChild := func(child string, file *memoryFile) {
+		if !strings.HasPrefix(child, childPrefix(key)) || child == key {
+			return
+		}
+		name := strings.SplitN(strings.TrimPrefix(child, childPrefix(key)), "/", 2)
+		if len(name) > 1 || file == nil {
+			entries[name[0]] = &storageFileInfo{name: name[0], dir: true}
+		} else {
+			entries[name[0]] = &storageFileInfo{name: name[0], size: int64(len(file.data)), modTime: file.modTime}
+		}
+	}
+	for filePath, file := range storage.files {
+		addChild(filePath, file)
+	}
+	for dirPath := range storage.dirs {
+		addChild(dirPath, nil)
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, entry)
+	}
+	sortFileInfos(files)
+
+	return files, nil
+}
+
+// Read returns the content of the file
+func (storage *MemoryStorage) Read(filePath string) (io.ReadCloser, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	file, found := storage.files[memoryPath(filePath)]
+	if !found {
+		return nil, notExist("open", filePath)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+// Put collects the data in memory and stores it on commit
+func (storage *MemoryStorage) Put(filePath string) (StorageFile, error) {
+	return &memoryPut{storage: storage, path: memoryPath(filePath)}, nil
+}
+
+// Move renames the file
+func (storage *MemoryStorage) Move(source, destination string, _ *CopyOptions) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	file, found := storage.files[memoryPath(source)]
+	if !found {
+		return notExist("move", source)
+	}
+
+	delete(storage.files, memoryPath(source))
+	storage.files[memoryPath(destination)] = file
+
+	return nil
+}
+
+// Delete removes the file or empty directory
+func (storage *MemoryStorage) Delete(filePath string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	key := memoryPath(filePath)
+	if _, found := storage.files[key]; found {
+		delete(storage.files, key)
+		return nil
+	}
+	if !storage.isDir(key) {
+		return notExist("remove", filePath)
+	}
+	if storage.hasChildren(key) {
+		return &os.PathError{Op: "remove", Path: filePath, Err: errors.New("directory not empty")}
+	}
+
+	delete(storage.dirs, key)
+	return nil
+}
+
+// Mkdir creates the directory and its parents
+func (storage *MemoryStorage) Mkdir(dir string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	for key := memoryPath(dir); key != "/"; key = path.Dir(key) {
+		storage.dirs[key] = true
+	}
+
+	return nil
+}
+
+// Link lets the destination share the content of the source
+func (storage *MemoryStorage) Link(source, destination string, _ *CopyOptions) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	file, found := storage.files[memoryPath(source)]
+	if !found {
+		return notExist("link", source)
+	}
+
+	storage.files[memoryPath(destination)] = file
+	return nil
+}
+
+func (storage *MemoryStorage) isDir(key string) bool {
+	return storage.dirs[key] || storage.hasChildren(key)
+}
+
+func (storage *MemoryStorage) hasChildren(key string) bool {
+	prefix := childPrefix(key)
+	for filePath := range storage.files {
+		if strings.HasPrefix(filePath, prefix) {
+			return true
+		}
+	}
+	for dirPath := range storage.dirs {
+		if dirPath != key && strings.HasPrefix(dirPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// childPrefix returns the prefix of the paths inside the directory
+func childPrefix(key string) string {
+	if key == "/" {
+		return key
+	}
+	return key + "/"
+}
+
+// memoryPut is a file that is being written to a memory storage
+type memoryPut struct {
+	storage *MemoryStorage
+	path    string
+	buffer  bytes.Buffer
+}
+
+func (file *memoryPut) Write(data []byte) (int, error) {
+	return file.buffer.Write(data)
+}
+
+func (file *memoryPut) Commit(_ bool) error {
+	file.storage.mutex.Lock()
+	defer file.storage.mutex.Unlock()
+
+	file.storage.files[file.path] = &memoryFile{data: file.buffer.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (file *memoryPut) Abort() {
+	file.buffer.Reset()
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables the credentials of S3 targets are read from
+const (
+	S3AccessKeyEnvironment    = "AWS_ACCESS_KEY_ID"
+	S3SecretKeyEnvironment    = "AWS_SECRET_ACCESS_KEY"
+	S3SessionTokenEnvironment = "AWS_SESSION_TOKEN"
+	S3RegionEnvironment       = "AWS_REGION"
+)
+
+// S3RegionDefault is used if the region is neither given in the target nor in the environment
+const S3RegionDefault = "us-east-1"
+
+// S3PartSize is the size of the first parts of a multipart upload. Files of at least this size are uploaded in parts, so
+// they do not have to be kept in memory completely. As an upload consists of at most S3MaxParts parts, the size is
+// doubled after every S3PartSizeSteps parts up to S3MaxPartSize, which allows files of almost 5 TiB, the size of the
+// largest objects.
+const (
+	S3PartSize      = 16 * 1024 * 1024
+	S3PartSizeSteps = 1000
+	S3MaxPartSize   = 1024 * 1024 * 1024
+	S3MaxParts      = 10000
+)
+
+// S3MaxCopySize is the size of the largest object that can be copied in a single request. Larger objects are copied in
+// parts of S3CopyPartSize.
+const (
+	S3MaxCopySize  = 5 * 1024 * 1024 * 1024
+	S3CopyPartSize = 512 * 1024 * 1024
+)
+
+// S3Storage stores the backups as objects in a bucket of an S3-compatible object storage. The keys of the objects are
+// the paths of the files inside the target, so the bucket can be browsed like the target directory. Directories only
+// exist through the objects in them, empty ones are kept as objects with a trailing slash.
+type S3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	root         string // Key of the target directory, it exists as long as the bucket does
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int
+	client       *http.Client
+}
+
+// openS3Storage opens a target given as s3://bucket/prefix. The endpoint of other S3-compatible storages than AWS and
+// the region can be given as parameters like s3://bucket/prefix?endpoint=http://localhost:9000&region=eu-central-1.
+// Buckets are always addressed by path.
+func openS3Storage(target *url.URL, _ *Arguments) (Storage, string, error) {
+	if target.Host == "" {
+		return nil, "", errors.New("the bucket is missing")
+	}
+
+	region := target.Query().Get("region")
+	if region == "" {
+		region = os.Getenv(S3RegionEnvironment)
+	}
+	if region == "" {
+		region = S3RegionDefault
+	}
+
+	endpoint := target.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, "", fmt.Errorf("the endpoint %s is not valid", endpoint)
+	}
+
+	storage := &S3Storage{
+		endpoint:     endpointURL,
+		bucket:       target.Host,
+		root:         strings.Trim(target.Path, "/"),
+		region:       region,
+		accessKey:    os.Getenv(S3AccessKeyEnvironment),
+		secretKey:    os.Getenv(S3SecretKeyEnvironment),
+		sessionToken: os.Getenv(S3SessionTokenEnvironment),
+		partSize:     S3PartSize,
+		client:       newHTTPClient(),
+	}
+	if storage.accessKey == "" || storage.secretKey == "" {
+		return nil, "", fmt.Errorf("the credentials must be given in %s and %s", S3AccessKeyEnvironment, S3SecretKeyEnvironment)
+	}
+
+	return storage, "/" + storage.root, nil
+}
+
+// key returns the key of the object at the given path
+func (storage *S3Storage) key(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(filePath)), "/")
+}
+
+// Stat returns the information about an object or a directory
+func (storage *S3Storage) Stat(filePath string) (os.FileInfo, error) {
+	key := storage.key(filePath)
+	if key == storage.root {
+		response, err := storage.request(http.MethodHead, "", nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		LogError(response.Body.Close)
+		if response.StatusCode != http.StatusOK {
+			return nil, s3Error("stat", filePath, response)
+		}
+		return &storageFileInfo{name: path.Base(key), dir: true}, nil
+	}
+
+	response, err := storage.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	LogError(response.Body.Close)
+	if response.StatusCode == http.StatusOK {
+		modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+		return &storageFileInfo{name: path.Base(key), size: response.ContentLength, modTime: modTime}, nil
+	} else if response.StatusCode != http.StatusNotFound {
+		return nil, s3Error("stat", filePath, response)
+	}
+
+	result, err := storage.list(key+"/", 1, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: filePath, Err: os.ErrNotExist}
+	}
+
+	return &storageFileInfo{name: path.Base(key), dir: true}, nil
+}
+
+// List returns the objects and directories in the directory sorted by name. Directories vanish with the last object in
+// them, so missing directories are listed as empty.
+func (storage *S3Storage) List(dir string) ([]os.FileInfo, error) {
+	prefix := storage.key(dir) + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	files := []os.FileInfo{}
+	token := ""
+	for {
+		result, err := storage.list(prefix, 0, token)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name == "" {
+				// Marker of the directory itself
+				continue
+			}
+			files = append(files, &storageFileInfo{name: name, size: object.Size, modTime: object.LastModified})
+		}
+		for _, common := range result.CommonPrefixes {
+			files = append(files, &storageFileInfo{name: strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/"), dir: true})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sortFileInfos(files)
+
+	return files, nil
+}
+
+// Read returns the content of the object
+func (storage *S3Storage) Read(filePath string) (io.ReadCloser, error) {
+	response, err := storage.request(http.MethodGet, storage.key(filePath), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		LogError(response.Body.Close)
+		return nil, s3Error("open", filePath, response)
+	}
+
+	return response.Body, nil
+}
+
+// Put uploads the data when it is committed. Large files are uploaded in parts while they are written. The object only
+// becomes visible when the upload is complete.
+func (storage *S3Storage) Put(filePath string) (StorageFile, error) {
+	return &s3Upload{storage: storage, path: filePath, key: storage.key(filePath)}, nil
+}
+
+// Move copies the object on the server and removes the source
+func (storage *S3Storage) Move(source, destination string, _ *CopyOptions) error {
+	info, err := storage.Stat(source)
+	if err != nil {
+		return err
+	} else if info.IsDir() {
+		return fmt.Errorf("%s is a directory", source)
+	}
+
+	sourceKey := storage.key(source)
+	destinationKey := storage.key(destination)
+	if info.Size() <= S3MaxCopySize {
+		header := http.Header{"X-Amz-Copy-Source": {storage.copySource(sourceKey)}}
+		response, err := storage.request(http.MethodPut, destinationKey, nil, header, nil)
+		if err != nil {
+			return err
+		}
+		err = s3Result("copy", destination, response, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = storage.copyParts(sourceKey, destinationKey, destination, info.Size())
+		if err != nil {
+			return err
+		}
+	}
+
+	return storage.Delete(source)
+}
+
+// copyParts copies a large object on the server using a multipart upload
+func (storage *S3Storage) copyParts(sourceKey, destinationKey, destination string, size int64) error {
+	upload := &s3Upload{storage: storage, path: destination, key: destinationKey}
+	err := upload.start()
+	if err != nil {
+		return err
+	}
+
+	for offset := int64(0); offset < size; offset += S3CopyPartSize {
+		end := offset + S3CopyPartSize
+		if end > size {
+			end = size
+		}
+		header := http.Header{
+			"X-Amz-Copy-Source":       {storage.copySource(sourceKey)},
+			"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, end-1)},
+		}
+		number := len(upload.parts) + 1
+		response, err := storage.request(http.MethodPut, destinationKey, upload.partQuery(number), header, nil)
+		if err != nil {
+			upload.Abort()
+			return err
+		}
+		result := struct {
+			ETag string `xml:"ETag"`
+		}{}
+		err = s3Result("copy", destination, response, &result)
+		if err != nil {
+			upload.Abort()
+			return err
+		}
+		upload.parts = append(upload.parts, s3Part{Number: number, ETag: result.ETag})
+	}
+
+	return upload.complete()
+}
+
+// copySource returns the value of the header naming the source of a copy
+func (storage *S3Storage) copySource(key string) string {
+	return s3EscapePath("/" + storage.bucket + "/" + key)
+}
+
+// Delete removes the object or the marker of an empty directory
+func (storage *S3Storage) Delete(filePath string) error {
+	key := storage.key(filePath)
+	response, err := storage.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	LogError(response.Body.Close)
+	if response.StatusCode == http.StatusNotFound {
+		result, err := storage.list(key+"/", 2, "")
+		if err != nil {
+			return err
+		}
+		if len(result.CommonPrefixes) > 0 || len(result.Contents) > 1 || len(result.Contents) == 1 && result.Contents[0].Key != key+"/" {
+			return &os.PathError{Op: "remove", Path: filePath, Err: errors.New("directory not empty")}
+		} else if len(result.Contents) == 0 {
+			return &os.PathError{Op: "remove", Path: filePath, Err: os.ErrNotExist}
+		}
+		key += "/"
+	} else if response.StatusCode != http.StatusOK {
+		return s3Error("remove", filePath, response)
+	}
+
+	response, err = storage.request(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return s3Result("remove", filePath, response, nil)
+}
+
+// Mkdir creates an object marking the directory, so it exists while it is empty
+func (storage *S3Storage) Mkdir(dir string) error {
+	key := storage.key(dir)
+	if key == "" || key == storage.root {
+		return nil
+	}
+
+	response, err := storage.request(http.MethodPut, key+"/", nil, nil, []byte{})
+	if err != nil {
+		return err
+	}
+	return s3Result("mkdir", dir, response, nil)
+}
+
+// s3ListResult is the response to a request listing objects
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the objects and directories directly inside the given prefix starting at the continuation token. Up to
+// maxKeys entries are returned, or as many as the server returns at once if maxKeys is 0.
+func (storage *S3Storage) list(prefix string, maxKeys int, token string) (*s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+
+	response, err := storage.request(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &s3ListResult{}
+	err = s3Result("list", "/"+prefix, response, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// request sends a signed request for the object with the given key, or for the bucket if the key is empty. A body of
+// nil sends no data.
+func (storage *S3Storage) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	requestURL := *storage.endpoint
+	requestURL.Path = "/" + storage.bucket
+	if key != "" {
+		requestURL.Path += "/" + key
+	}
+	requestURL.RawPath = s3EscapePath(requestURL.Path)
+	requestURL.RawQuery = s3CanonicalQuery(query)
+
+	request, err := http.NewRequest(method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if storage.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", storage.sessionToken)
+	}
+
+	payloadHash := sha256.Sum256(body)
+	signS3Request(request, hex.EncodeToString(payloadHash[:]), storage.region, storage.accessKey, storage.secretKey, time.Now())
+
+	return storage.client.Do(request)
+}
+
+// s3Result reads the response into the result, which may be nil. Some requests report errors with a successful status,
+// so the body is checked for errors.
+func s3Result(op, filePath string, response *http.Response, result interface{}) error {
+	defer LogError(response.Body.Close)
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		return s3Error(op, filePath, response)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return s3Error(op, filePath, &http.Response{StatusCode: response.StatusCode, Body: ioutil.NopCloser(bytes.NewReader(data))})
+	}
+	if result == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	return xml.Unmarshal(data, result)
+}
+
+// s3Error returns the error reported in the response. Missing objects are reported as not existing.
+func s3Error(op, filePath string, response *http.Response) error {
+	if response.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+	}
+
+	reported := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	data, _ := ioutil.ReadAll(response.Body)
+	if xml.Unmarshal(data, &reported) != nil || reported.Code == "" {
+		return &os.PathError{Op: op, Path: filePath, Err: fmt.Errorf("status %d", response.StatusCode)}
+	}
+
+	return &os.PathError{Op: op, Path: filePath, Err: fmt.Errorf("%s: %s", reported.Code, reported.Message)}
+}
+
+// s3Part is a part of a multipart upload
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// s3Upload is an object that is being written to an S3 storage. The data is kept in memory up to the size of a part.
+type s3Upload struct {
+	storage  *S3Storage
+	path     string
+	key      string
+	buffer   bytes.Buffer
+	uploadID string
+	parts    []s3Part
+}
+
+func (upload *s3Upload) Write(data []byte) (int, error) {
+	n, _ := upload.buffer.Write(data)
+	for upload.buffer.Len() >= upload.partSize() {
+		err := upload.uploadPart(upload.buffer.Next(upload.partSize()))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// partSize returns the size of the next part
+func (upload *s3Upload) partSize() int {
+	size := int64(upload.storage.partSize) << uint(len(upload.parts)/S3PartSizeSteps)
+	if size > S3MaxPartSize {
+		size = S3MaxPartSize
+	}
+	return int(size)
+}
+
+// Commit uploads the data. The sync flag is ignored, as objects are stored durably once the upload succeeded.
+func (upload *s3Upload) Commit(_ bool) error {
+	if upload.uploadID == "" {
+		response, err := upload.storage.request(http.MethodPut, upload.key, nil, nil, upload.buffer.Bytes())
+		if err != nil {
+			return err
+		}
+		return s3Result("put", upload.path, response, nil)
+	}
+
+	if upload.buffer.Len() > 0 {
+		err := upload.uploadPart(upload.buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return upload.complete()
+}
+
+// Abort discards the data and the parts uploaded so far
+func (upload *s3Upload) Abort() {
+	upload.buffer.Reset()
+	if upload.uploadID == "" {
+		return
+	}
+
+	response, err := upload.storage.request(http.MethodDelete, upload.key, url.Values{"uploadId": {upload.uploadID}}, nil, nil)
+	if err == nil {
+		err = s3Result("abort", upload.path, response, nil)
+	}
+	if err != nil {
+		Log.F(OutputLevelWarning, "Could not abort upload of %s: %s", upload.path, err.Error())
+	}
+	upload.uploadID = ""
+}
+
+// start initiates a multipart upload
+func (upload *s3Upload) start() error {
+	response, err := upload.storage.request(http.MethodPost, upload.key, url.Values{"uploads": {""}}, nil, []byte{})
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = s3Result("put", upload.path, response, &result)
+	if err != nil {
+		return err
+	} else if result.UploadID == "" {
+		return &os.PathError{Op: "put", Path: upload.path, Err: errors.New("no upload id returned")}
+	}
+	upload.uploadID = result.UploadID
+
+	return nil
+}
+
+// uploadPart uploads the next part, starting the multipart upload if needed
+func (upload *s3Upload) uploadPart(data []byte) error {
+	number := len(upload.parts) + 1
+	if number > S3MaxParts {
+		upload.Abort()
+		return &os.PathError{Op: "put", Path: upload.path, Err: fmt.Errorf("the file is too large for an upload in %d parts", S3MaxParts)}
+	}
+
+	if upload.uploadID == "" {
+		err := upload.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	response, err := upload.storage.request(http.MethodPut, upload.key, upload.partQuery(number), nil, data)
+	if err == nil {
+		err = s3Result("put", upload.path, response, nil)
+	}
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+	upload.parts = append(upload.parts, s3Part{Number: number, ETag: response.Header.Get("ETag")})
+
+	return nil
+}
+
+func (upload *s3Upload) partQuery(number int) url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.uploadID}}
+}
+
+// complete assembles the uploaded parts into the object
+func (upload *s3Upload) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: upload.parts})
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+
+	response, err := upload.storage.request(http.MethodPost, upload.key, url.Values{"uploadId": {upload.uploadID}}, nil, body)
+	if err == nil {
+		err = s3Result("put", upload.path, response, nil)
+	}
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+
+	return nil
+}
+
+// signS3Request signs the request using AWS Signature Version 4. The host and all headers set on the request are
+// signed.
+func signS3Request(request *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		headers[strings.ToLower(name)] = request.Header.Get(name)
+	}
+
+	signedHeaders, signature := s3Signature(secretKey, region, amzDate, request.Method, request.URL.EscapedPath(), s3CanonicalQuery(request.URL.Query()), headers, payloadHash)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKey, s3Scope(amzDate, region), signedHeaders, signature))
+}
+
+// s3Signature returns the names of the signed headers and the signature of a request. The names of the headers must
+// be lower case.
+func s3Signature(secretKey, region, amzDate, method, uri, query string, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		_, _ = fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, strings.Join(strings.Fields(headers[name]), " "))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{method, uri, query, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, s3Scope(amzDate, region), hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	return signedHeaders, hex.EncodeToString(key)
+}
+
+// s3Scope returns the scope of the credentials a request is signed with
+func s3Scope(amzDate, region string) string {
+	return amzDate[:8] + "/" + region + "/s3/aws4_request"
+}
+
+// s3CanonicalQuery encodes the parameters sorted by name as required for signing
+func s3CanonicalQuery(query url.Values) string {
+	parameters := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			parameters = append(parameters, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(parameters)
+
+	return strings.Join(parameters, "&")
+}
+
+// s3EscapePath encodes the path of a request, keeping the slashes
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3Escape encodes all characters except the unreserved ones as required for signing
+func s3Escape(value string, keepSlash bool) string {
+	escaped := &strings.Builder{}
+	for _, c := range []byte(value) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || keepSlash && c == '/' {
+			escaped.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPPortDefault is used if the target does not contain a port
+const SFTPPortDefault = "22"
+
+// Timeouts of the connection to the remote host. A connection that does not answer the keepalive requests in time is
+// closed, so a stalled host fails the backup instead of hanging it.
+const (
+	SFTPDialTimeout       = 30 * time.Second
+	SFTPKeepAliveInterval = 30 * time.Second
+)
+
+// sftpOpUnsupported is the status returned by servers that do not support a request
+const sftpOpUnsupported = 8
+
+// sftpKeyFiles are the private keys in the .ssh directory of the user that are tried if no key is given
+var sftpKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// SFTPStorage stores the backups in a directory of a remote host reached by SSH. Files are streamed over the
+// connection, moves and hard links are done on the remote host.
+type SFTPStorage struct {
+	client *sftp.Client
+}
+
+// openSFTPStorage opens a target given as sftp://user@host:port/path. The host key must be listed in the known hosts
+// of the user or in the file given as parameter like sftp://host/path?known-hosts=/path/to/known_hosts. The user is
+// authenticated using the SSH agent and the private key given as parameter key or the default keys of the user.
+// Encrypted keys can only be used through the agent.
+func openSFTPStorage(target *url.URL, _ *Arguments) (Storage, string, error) {
+	if target.Hostname() == "" {
+		return nil, "", errors.New("the host is missing")
+	}
+
+	home, _ := os.UserHomeDir()
+	knownHosts := target.Query().Get("known-hosts")
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read known hosts: %s", err.Error())
+	}
+
+	user := target.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	keyFiles := []string{target.Query().Get("key")}
+	if keyFiles[0] == "" {
+		keyFiles = keyFiles[:0]
+		for _, name := range sftpKeyFiles {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            sftpAuthMethods(keyFiles, target.Query().Get("key") != ""),
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         SFTPDialTimeout,
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = SFTPPortDefault
+	}
+	connection, err := ssh.Dial("tcp", net.JoinHostPort(target.Hostname(), port), config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	go sftpKeepAlive(connection, SFTPKeepAliveInterval)
+
+	client, err := sftp.NewClient(connection)
+	if err != nil {
+		LogError(connection.Close)
+		return nil, "", err
+	}
+
+	location := path.Clean("/" + target.Path)
+	return &SFTPStorage{client: client}, location, nil
+}
+
+// sftpKeepAlive sends a keepalive request in every interval until the connection is closed. The connection is closed if
+// a request fails or is not answered within the interval.
+func sftpKeepAlive(connection ssh.Conn, interval time.Duration) {
+	closed := make(chan struct{})
+	go func() {
+		_ = connection.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := connection.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+
+		select {
+		case <-closed:
+			return
+		case err := <-answered:
+			if err == nil {
+				continue
+			}
+			Log.F(OutputLevelError, "The connection to the remote host failed: %s", err.Error())
+		case <-time.After(interval):
+			Log.F(OutputLevelError, "The remote host did not answer for %s, closing the connection", interval)
+		}
+		_ = connection.Close()
+		return
+	}
+}
+
+// sftpAuthMethods returns the methods to authenticate with the SSH agent, if running, and the given private keys.
+// Missing keys are skipped unless required.
+func sftpAuthMethods(keyFiles []string, required bool) []ssh.AuthMethod {
+	signers := []ssh.Signer{}
+	for _, keyFile := range keyFiles {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			if required || !os.IsNotExist(err) {
+				Log.F(OutputLevelWarning, "Could not read private key %s: %s", keyFile, err.Error())
+			}
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			Log.F(OutputLevelWarning, "Could not use private key %s: %s", keyFile, err.Error())
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	methods := []ssh.AuthMethod{}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		connection, err := net.Dial("unix", socket)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(connection).Signers))
+		} else {
+			Log.F(OutputLevelWarning, "Could not connect to the SSH agent: %s", err.Error())
+		}
+	}
+
+	return append(methods, ssh.PublicKeys(signers...))
+}
+
+// Stat returns the information about a file without following symlinks
+func (storage *SFTPStorage) Stat(filePath string) (os.FileInfo, error) {
+	return storage.client.Lstat(filepath.ToSlash(filePath))
+}
+
+// List returns the entries of the directory sorted by name
+func (storage *SFTPStorage) List(dir string) ([]os.FileInfo, error) {
+	files, err := storage.client.ReadDir(filepath.ToSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+	sortFileInfos(files)
+
+	return files, nil
+}
+
+// Read opens the file for reading
+func (storage *SFTPStorage) Read(filePath string) (io.ReadCloser, error) {
+	return storage.client.Open(filepath.ToSlash(filePath))
+}
+
+// Put writes a temporary file next to the given path, which is renamed on commit
+func (storage *SFTPStorage) Put(filePath string) (StorageFile, error) {
+	remotePath := filepath.ToSlash(filePath)
+	err := storage.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := storage.client.Create(remotePath + ".part")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpFile{File: file, storage: storage, path: remotePath}, nil
+}
+
+// Move renames the file on the remote host
+func (storage *SFTPStorage) Move(source, destination string, _ *CopyOptions) error {
+	remotePath := filepath.ToSlash(destination)
+	err := storage.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+
+	return storage.rename(filepath.ToSlash(source), remotePath)
+}
+
+// Delete removes the file or empty directory
+func (storage *SFTPStorage) Delete(filePath string) error {
+	return storage.client.Remove(filepath.ToSlash(filePath))
+}
+
+// Mkdir creates the directory and its parents
+func (storage *SFTPStorage) Mkdir(dir string) error {
+	return storage.client.MkdirAll(filepath.ToSlash(dir))
+}
+
+// Link creates a hard link on the remote host, if the server supports it
+func (storage *SFTPStorage) Link(source, destination string, _ *CopyOptions) error {
+	remotePath := filepath.ToSlash(destination)
+	err := storage.client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+
+	return storage.client.Link(filepath.ToSlash(source), remotePath)
+}
+
+// rename replaces the destination by the source. Servers that cannot replace files on rename get the destination
+// removed first, so on these servers the destination is missing for a moment and is lost if the connection breaks in
+// between.
+func (storage *SFTPStorage) rename(source, destination string) error {
+	err := storage.client.PosixRename(source, destination)
+	if status, ok := err.(*sftp.StatusError); ok && status.Code == sftpOpUnsupported {
+		err = storage.client.Remove(destination)
+		if err == nil || os.IsNotExist(err) {
+			err = storage.client.Rename(source, destination)
+		}
+	}
+
+	return err
+}
+
+// sftpFile is a temporary file on the remote host that replaces the file at path on commit
+type sftpFile struct {
+	*sftp.File
+	storage *SFTPStorage
+	path    string
+}
+
+// Commit closes and renames the file. The sync flag is ignored, as files cannot be flushed to stable storage using
+// SFTP, so neither the file nor the rename survive a power failure of the remote host for sure.
+func (file *sftpFile) Commit(_ bool) error {
+	err := file.Close()
+	if err == nil {
+		err = file.storage.rename(file.Name(), file.path)
+	}
+	if err != nil {
+		_ = file.storage.client.Remove(file.Name())
+	}
+
+	return err
+}
+
+func (file *sftpFile) Abort() {
+	_ = file.Close()
+	_ = file.storage.client.Remove(file.Name())
+}
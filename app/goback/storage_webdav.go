@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WebDAVPasswordEnvironment is the environment variable the password of a WebDAV target is read from
+const WebDAVPasswordEnvironment = "GOBACK_WEBDAV_PASSWORD"
+
+// webdavPropfind requests the properties needed to describe a file
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// WebDAVStorage stores the backups in a collection of a WebDAV server. Files are uploaded next to their path and moved
+// into place once complete, unchanged files are moved on the server.
+type WebDAVStorage struct {
+	base     *url.URL // Scheme and host of the server
+	user     string
+	password string
+	client   *http.Client
+	dirs     map[string]bool // Collections known to exist
+	mutex    sync.Mutex
+}
+
+// openWebDAVStorage opens a target given as webdav://user@host/path or as webdavs://user@host/path for HTTPS. The
+// password is read from the environment.
+func openWebDAVStorage(target *url.URL, _ *Arguments) (Storage, string, error) {
+	if target.Host == "" {
+		return nil, "", errors.New("the host is missing")
+	}
+
+	base := &url.URL{Scheme: "http", Host: target.Host}
+	if target.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+
+	storage := &WebDAVStorage{
+		base:     base,
+		user:     target.User.Username(),
+		password: os.Getenv(WebDAVPasswordEnvironment),
+		client:   newHTTPClient(),
+		dirs:     map[string]bool{"/": true},
+	}
+
+	return storage, path.Clean("/" + target.Path), nil
+}
+
+// Stat returns the information about a file or collection
+func (storage *WebDAVStorage) Stat(filePath string) (os.FileInfo, error) {
+	files, err := storage.propfind(filePath, "0")
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: filePath, Err: errors.New("no properties returned")}
+	}
+
+	return files[0], nil
+}
+
+// List returns the files and collections in the collection sorted by name
+func (storage *WebDAVStorage) List(dir string) ([]os.FileInfo, error) {
+	files, err := storage.propfind(dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	sortFileInfos(files)
+
+	return files, nil
+}
+
+// Read returns the content of the file
+func (storage *WebDAVStorage) Read(filePath string) (io.ReadCloser, error) {
+	response, err := storage.request(http.MethodGet, filePath, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		LogError(response.Body.Close)
+		return nil, webdavError("open", filePath, response)
+	}
+
+	return response.Body, nil
+}
+
+// Put uploads the data to a temporary file next to the given path, which is moved into place on commit. As the size
+// is not known in advance, the data is spooled to a local temporary file until then.
+func (storage *WebDAVStorage) Put(filePath string) (StorageFile, error) {
+	remotePath := webdavPath(filePath)
+	err := storage.mkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := ioutil.TempFile("", "goback-webdav-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &webdavUpload{storage: storage, path: remotePath, spool: spool}, nil
+}
+
+// PutSize streams the data of the given size to a temporary file next to the given path, which is moved into place on
+// commit
+func (storage *WebDAVStorage) PutSize(filePath string, size int64) (StorageFile, error) {
+	remotePath := webdavPath(filePath)
+	err := storage.mkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	upload := &webdavUpload{storage: storage, path: remotePath, size: size, writer: writer, done: make(chan error, 1)}
+	go func() {
+		err := storage.put(remotePath+".part", reader, size)
+		// Unblock writes if the request failed before reading everything
+		_ = reader.CloseWithError(err)
+		upload.done <- err
+	}()
+
+	return upload, nil
+}
+
+// Move moves the file on the server
+func (storage *WebDAVStorage) Move(source, destination string, _ *CopyOptions) error {
+	remotePath := webdavPath(destination)
+	err := storage.mkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+
+	return storage.move(webdavPath(source), remotePath)
+}
+
+// Delete removes the file or empty collection. Collections are checked first, as the server would delete them with
+// their content.
+func (storage *WebDAVStorage) Delete(filePath string) error {
+	remotePath := webdavPath(filePath)
+	files, err := storage.propfind(remotePath, "1")
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return &os.PathError{Op: "remove", Path: filePath, Err: errors.New("directory not empty")}
+	}
+
+	response, err := storage.request(http.MethodDelete, remotePath, nil, nil)
+	if err != nil {
+		return err
+	}
+	err = webdavResult("remove", filePath, response)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.dirs, remotePath)
+
+	return nil
+}
+
+// Mkdir creates the collection and its parents
+func (storage *WebDAVStorage) Mkdir(dir string) error {
+	return storage.mkdirAll(webdavPath(dir))
+}
+
+// mkdirAll creates the collection and the parents that do not exist yet
+func (storage *WebDAVStorage) mkdirAll(dir string) error {
+	storage.mutex.Lock()
+	known := storage.dirs[dir]
+	storage.mutex.Unlock()
+	if known {
+		return nil
+	}
+
+	info, err := storage.Stat(dir)
+	if err == nil && !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+	} else if os.IsNotExist(err) {
+		err = storage.mkdirAll(path.Dir(dir))
+		if err != nil {
+			return err
+		}
+
+		var response *http.Response
+		response, err = storage.request("MKCOL", dir, nil, nil)
+		if err == nil {
+			err = webdavResult("mkdir", dir, response)
+		}
+		if err != nil && response != nil && response.StatusCode == http.StatusMethodNotAllowed {
+			// Created concurrently
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.dirs[dir] = true
+
+	return nil
+}
+
+// put uploads the data of the given size. The size is always sent, as servers behind proxies may store uploads sent
+// without it as empty files or reject them.
+func (storage *WebDAVStorage) put(remotePath string, body io.Reader, size int64) error {
+	header := http.Header{"X-Expected-Entity-Length": {strconv.FormatInt(size, 10)}}
+	request, err := storage.newRequest(http.MethodPut, remotePath, header, body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	if size == 0 {
+		// A length of 0 with a body is sent as unknown
+		request.Body = http.NoBody
+	}
+
+	response, err := storage.client.Do(request)
+	if err != nil {
+		return err
+	}
+	return webdavResult("put", remotePath, response)
+}
+
+// move moves a file on the server, replacing the destination
+func (storage *WebDAVStorage) move(source, destination string) error {
+	target := *storage.base
+	target.Path = destination
+	header := http.Header{"Destination": {target.String()}, "Overwrite": {"T"}}
+
+	response, err := storage.request("MOVE", source, header, nil)
+	if err != nil {
+		return err
+	}
+	return webdavResult("move", source, response)
+}
+
+// webdavMultistatus is the response to a PROPFIND request
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"href"`
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind returns the properties of the file or collection for depth 0 or the properties of its members for depth 1
+func (storage *WebDAVStorage) propfind(filePath, depth string) ([]os.FileInfo, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	response, err := storage.request("PROPFIND", filePath, header, strings.NewReader(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer LogError(response.Body.Close)
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError("stat", filePath, response)
+	}
+
+	result := &webdavMultistatus{}
+	err = xml.NewDecoder(response.Body).Decode(result)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: filePath, Err: err}
+	}
+
+	files := make([]os.FileInfo, 0, len(result.Responses))
+	for _, entry := range result.Responses {
+		href, err := url.Parse(entry.Href)
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: filePath, Err: err}
+		}
+
+		hrefPath := path.Clean("/" + href.Path)
+		if depth != "0" && hrefPath == webdavPath(filePath) {
+			continue
+		}
+
+		info := &storageFileInfo{name: path.Base(hrefPath)}
+		for _, propstat := range entry.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			info.dir = info.dir || propstat.Prop.ResourceType.Collection != nil
+			if size, err := strconv.ParseInt(propstat.Prop.ContentLength, 10, 64); err == nil {
+				info.size = size
+			}
+			if modTime, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				info.modTime = modTime
+			}
+		}
+		files = append(files, info)
+	}
+
+	return files, nil
+}
+
+// request sends a request for the given path
+func (storage *WebDAVStorage) request(method, filePath string, header http.Header, body io.Reader) (*http.Response, error) {
+	request, err := storage.newRequest(method, filePath, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.client.Do(request)
+}
+
+// newRequest creates a request for the given path
+func (storage *WebDAVStorage) newRequest(method, filePath string, header http.Header, body io.Reader) (*http.Request, error) {
+	requestURL := *storage.base
+	requestURL.Path = webdavPath(filePath)
+
+	request, err := http.NewRequest(method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if storage.user != "" {
+		request.SetBasicAuth(storage.user, storage.password)
+	}
+
+	return request, nil
+}
+
+// webdavPath returns the path of the file on the server
+func webdavPath(filePath string) string {
+	return path.Clean("/" + filepath.ToSlash(filePath))
+}
+
+// webdavResult checks the response of a request that returns no data
+func webdavResult(op, filePath string, response *http.Response) error {
+	defer LogError(response.Body.Close)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return webdavError(op, filePath, response)
+	}
+
+	return nil
+}
+
+// webdavError returns the error reported in the response. Missing files are reported as not existing.
+func webdavError(op, filePath string, response *http.Response) error {
+	if response.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+	}
+
+	return &os.PathError{Op: op, Path: filePath, Err: fmt.Errorf("status %s", response.Status)}
+}
+
+// webdavUpload is a file that is being streamed to a WebDAV server or spooled to a local file until it is complete
+type webdavUpload struct {
+	storage *WebDAVStorage
+	path    string
+	size    int64
+	writer  *io.PipeWriter
+	done    chan error
+	spool   *os.File
+}
+
+func (upload *webdavUpload) Write(data []byte) (int, error) {
+	if upload.spool != nil {
+		written, err := upload.spool.Write(data)
+		upload.size += int64(written)
+		return written, err
+	}
+
+	return upload.writer.Write(data)
+}
+
+// Commit finishes the upload and moves the file into place. As servers may store incomplete uploads without reporting
+// an error, the size of the stored file is checked. The sync flag is ignored, as files cannot be flushed to stable
+// storage using WebDAV.
+func (upload *webdavUpload) Commit(_ bool) error {
+	err := upload.finish()
+	if err == nil {
+		err = upload.storage.move(upload.path+".part", upload.path)
+	}
+	if err != nil {
+		upload.remove(upload.path + ".part")
+		return err
+	}
+
+	info, err := upload.storage.Stat(upload.path)
+	if err == nil && info.Size() != upload.size {
+		err = &os.PathError{
+			Op:   "put",
+			Path: upload.path,
+			Err:  fmt.Errorf("%d of %d bytes stored", info.Size(), upload.size),
+		}
+	}
+	if err != nil {
+		upload.remove(upload.path)
+	}
+
+	return err
+}
+
+// finish completes the upload of the temporary file
+func (upload *webdavUpload) finish() error {
+	if upload.spool == nil {
+		_ = upload.writer.Close()
+		return <-upload.done
+	}
+
+	defer upload.closeSpool()
+	_, err := upload.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	// The client closes bodies that can be closed
+	return upload.storage.put(upload.path+".part", ioutil.NopCloser(upload.spool), upload.size)
+}
+
+// Abort ends the upload and removes the temporary file. The request is finished instead of cancelled, as the server
+// could otherwise still be writing the file after it was removed.
+func (upload *webdavUpload) Abort() {
+	if upload.spool != nil {
+		upload.closeSpool()
+		return
+	}
+
+	_ = upload.writer.Close()
+	<-upload.done
+	upload.remove(upload.path + ".part")
+}
+
+// closeSpool closes and removes the local temporary file
+func (upload *webdavUpload) closeSpool() {
+	LogError(upload.spool.Close)
+	LogError(func() error { return os.Remove(upload.spool.Name()) })
+}
+
+// remove deletes the file on the server
+func (upload *webdavUpload) remove(remotePath string) {
+	response, err := upload.storage.request(http.MethodDelete, remotePath, nil, nil)
+	if err == nil {
+		LogError(response.Body.Close)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// stream creates the backup while the source is still being read. Every file is moved or copied as soon as its hash
+// is known and the manifest is written incrementally. The source is read in sorted order and merge-joined with the
+// manifest of the reference, so the memory used does not depend on the number of files. The checks that need the
+// hashes of all files are skipped.
+func (backup *Backup) stream() *Exit {
+	var reference *ManifestReader
+	if !backup.Initial {
+		var exit *Exit
+		reference, exit = backup.openReference()
+		if exit != nil {
+			return exit
+		}
+		defer LogError(reference.Close)
+	}
+	lookup := NewManifestLookup(reference)
+
+	exit := backup.checkEmptySource()
+	if exit != nil {
+		return exit
+	}
+
+	exit = backup.createDirectory()
+	if exit != nil {
+		return exit
+	}
+
+	if backup.Initial {
+		Log.F(OutputLevelInfo, "Creating initial copy in %s", backup.To)
+	}
+
+	backup.prepareDedup()
+
+	manifest, exit := CreateManifest(backup.Storage, backup.To+"."+HashesExtension, backup.Configuration.CompressManifests, backup.Configuration.syncMetadata(), backup.Options.Cipher)
+	if exit != nil {
+		return exit
+	}
+
+	Log.F(OutputLevelInfo, "Streaming backup of %s...", backup.From)
+	backup.Statistics.Start()
+	exit = runJobs(backup.Workers, func(queue queueFunction) *Exit {
+		var lookupExit *Exit
+		// The number of files per second is limited when handling the files. The walk cannot run ahead, as the queue
+		// is bounded.
+		exit := walkDirectory(backup.From, "", backup.Configuration.Traversal, func(filePath string, entry *ManifestEntry) bool {
+			refEntry, err := lookup.Find(filePath)
+			if err != nil {
+				lookupExit = &Exit{
+					Message: fmt.Sprintf("ERROR: Could not read hashes for %s: %s", backup.Ref, err.Error()),
+					Code:    ExitcodeNoReference,
+				}
+				return false
+			}
+
+			return queue(func(log *LogBuffer) *Exit {
+				return backup.handleFile(log, filePath, entry, refEntry)
+			}, func() *Exit {
+				return manifest.Add(filePath, entry)
+			})
+		})
+		if exit == nil {
+			exit = lookupExit
+		}
+		return exit
+	})
+	if exit == nil {
+		exit = backup.Options.Directories.Sync()
+	}
+	if exit != nil {
+		manifest.Abort()
+		return exit
+	}
+
+	exit = manifest.Close()
+	if exit != nil {
+		return exit
+	}
+
+	exit = backup.finish()
+	if exit != nil {
+		return exit
+	}
+
+	backup.Statistics.Log()
+
+	return nil
+}
+
+// checkEmptySource aborts if the source directory is empty but the last backup is not, as the source is most likely
+// not mounted. The pipeline cannot compare the number of changed files before copying.
+func (backup *Backup) checkEmptySource() *Exit {
+	if backup.Initial || backup.Force {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(backup.From)
+	if err != nil || len(files) > 0 {
+		return nil
+	}
+	files, err = backup.Storage.List(backup.Ref)
+	if err != nil || len(files) == 0 {
+		return nil
+	}
+
+	return &Exit{
+		Message: fmt.Sprintf("Source directory %s is empty, but the last backup is not. Make sure it is mounted or use -force to backup anyway", backup.From),
+		Code:    ExitcodeTooManyChanges,
+	}
+}
+
+// openReference opens the manifest of the reference. It is created if it cannot be read.
+func (backup *Backup) openReference() (*ManifestReader, *Exit) {
+	hashFile := backup.Ref + "." + HashesExtension
+
+	reference, err := OpenManifest(backup.Storage, hashFile, backup.Options.Cipher)
+	if err == nil {
+		return reference, nil
+	}
+	Log.F(OutputLevelWarning, "Could not read hashes from %s: %s", hashFile, err.Error())
+
+	_, exit := backup.getHashes(backup.Ref)
+	if exit != nil {
+		return nil, exit
+	}
+
+	reference, err = OpenManifest(backup.Storage, hashFile, backup.Options.Cipher)
+	if err != nil {
+		return nil, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not read hashes from %s: %s", hashFile, err.Error()),
+			Code:    ExitcodeNoReference,
+		}
+	}
+
+	return reference, nil
+}
+
+// walkDirectory calls the given function with the entry of every file in the directory tree as soon as it is known.
+// The files are passed in sorted order of their paths, the traversal only changes the order in which the directories
+// are read from disk. Stops walking if the function returns false.
+func walkDirectory(dir, prefix, traversal string, fn func(filePath string, entry *ManifestEntry) bool) *Exit {
+	_, exit := walkDirectoryRecursive(dir, prefix, traversal, fn)
+	return exit
+}
+
+func walkDirectoryRecursive(dir, prefix, traversal string, fn func(filePath string, entry *ManifestEntry) bool) (bool, *Exit) {
+	files, err := readDirectory(dir, traversal)
+	if err != nil {
+		return false, &Exit{
+			Message: fmt.Sprintf("ERROR: Could not read directory %s: %s", dir, err.Error()),
+			Code:    ExitcodeReadDirectory,
+		}
+	}
+
+	sortFilesByPath(files)
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() {
+			next, exit := walkDirectoryRecursive(filepath.Join(dir, name), prefix+name+"/", traversal, fn)
+			if exit != nil {
+				Log.F(OutputLevelError, exit.Message)
+			} else if !next {
+				return false, nil
+			}
+		} else {
+			if !fn(prefix+name, NewManifestEntry(file)) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// sortFilesByPath sorts the entries of a directory in the order their paths appear in a manifest. Directories are
+// sorted by their name including the trailing slash.
+func sortFilesByPath(files []os.FileInfo) {
+	sortKey := func(file os.FileInfo) string {
+		if file.IsDir() {
+			return file.Name() + "/"
+		}
+		return file.Name()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return sortKey(files[i]) < sortKey(files[j])
+	})
+}
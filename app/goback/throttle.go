@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize is the amount of data copied at once while the bandwidth is limited
+const throttleChunkSize = 256 * 1024
+
+// Throttle limits the bandwidth used for copying and the number of files processed per second. It is safe to use from
+// several goroutines, so all workers share the same limits. A nil Throttle does not limit anything.
+type Throttle struct {
+	bytesPerSecond float64
+	filesPerSecond float64
+
+	nextBytes time.Time
+	nextFile  time.Time
+	mutex     sync.Mutex
+}
+
+// NewThrottle creates a throttle for the given bandwidth in MiB/s and number of files per second. A limit of 0
+// disables it. Returns nil if nothing is limited.
+func NewThrottle(bandwidth float64, filesPerSecond int) *Throttle {
+	if bandwidth <= 0 && filesPerSecond <= 0 {
+		return nil
+	}
+
+	return &Throttle{
+		bytesPerSecond: bandwidth * 1024 * 1024,
+		filesPerSecond: float64(filesPerSecond),
+	}
+}
+
+// LimitsBandwidth returns true if the bandwidth is limited
+func (throttle *Throttle) LimitsBandwidth() bool {
+	return throttle != nil && throttle.bytesPerSecond > 0
+}
+
+// WaitBytes blocks until the given amount of data may be read or written
+func (throttle *Throttle) WaitBytes(bytes int64) {
+	if !throttle.LimitsBandwidth() {
+		return
+	}
+	time.Sleep(throttle.reserve(&throttle.nextBytes, float64(bytes), throttle.bytesPerSecond))
+}
+
+// WaitFile blocks until the next file may be processed
+func (throttle *Throttle) WaitFile() {
+	if throttle == nil || throttle.filesPerSecond <= 0 {
+		return
+	}
+	time.Sleep(throttle.reserve(&throttle.nextFile, 1, throttle.filesPerSecond))
+}
+
+// reserve returns how long to wait before the amount may be used and moves the next free time slot accordingly
+func (throttle *Throttle) reserve(next *time.Time, amount, rate float64) time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	if next.Before(now) {
+		*next = now
+	}
+	wait := next.Sub(now)
+	*next = next.Add(time.Duration(amount / rate * float64(time.Second)))
+
+	return wait
+}
+
+// Reader returns a reader that reads from the given one without exceeding the bandwidth
+func (throttle *Throttle) Reader(reader io.Reader) io.Reader {
+	if !throttle.LimitsBandwidth() {
+		return reader
+	}
+	return &throttledReader{reader: reader, throttle: throttle}
+}
+
+type throttledReader struct {
+	reader   io.Reader
+	throttle *Throttle
+}
+
+func (reader *throttledReader) Read(data []byte) (int, error) {
+	if len(data) > throttleChunkSize {
+		data = data[:throttleChunkSize]
+	}
+	n, err := reader.reader.Read(data)
+	reader.throttle.WaitBytes(int64(n))
+	return n, err
+}
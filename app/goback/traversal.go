@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Orders in which the files are read. Reading in the order of the inodes or of the data on disk avoids seeking on
+// spinning disks.
+const (
+	TraversalName   = "name"   // Sorted by name
+	TraversalInode  = "inode"  // Sorted by inode number
+	TraversalExtent = "extent" // Sorted by the physical location of the data, directories are read in inode order
+)
+
+// readDirectory returns the entries of the given directory. Unless the traversal is by name, the entries are read from
+// disk in the order of their inodes. The entries are always returned sorted by name.
+func readDirectory(dir, traversal string) ([]os.FileInfo, error) {
+	if traversal == TraversalName || traversal == "" {
+		return ioutil.ReadDir(dir)
+	}
+
+	names, inodes, err := readDirectoryInodes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return inodes[order[i]] < inodes[order[j]]
+	})
+
+	files := make([]os.FileInfo, 0, len(names))
+	for _, i := range order {
+		info, err := os.Lstat(filepath.Join(dir, names[i]))
+		if os.IsNotExist(err) {
+			// Deleted while reading the directory
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	return files, nil
+}
+
+// orderFiles returns the paths of the files in the order in which their content should be read. The paths are
+// relative to the given directory.
+func orderFiles(dir string, files []string, entries map[string]*ManifestEntry, traversal string) []string {
+	if traversal != TraversalInode && traversal != TraversalExtent {
+		return files
+	}
+
+	keys := make(map[string]uint64, len(files))
+	if traversal == TraversalExtent {
+		for _, filePath := range files {
+			offset, err := fileExtentOffset(filepath.Join(dir, filePath))
+			if err != nil {
+				Log.F(OutputLevelDebug, "Could not read the location of %s, using inode order: %s", filePath, err.Error())
+				keys = make(map[string]uint64, len(files))
+				break
+			}
+			keys[filePath] = offset
+		}
+	}
+	if len(keys) == 0 {
+		for _, filePath := range files {
+			if entry := entries[filePath]; entry != nil {
+				keys[filePath] = entry.Inode
+			}
+		}
+	}
+
+	ordered := make([]string, len(files))
+	copy(ordered, files)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i]] < keys[ordered[j]]
+	})
+
+	return ordered
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsIocFiemap is the ioctl to read the extents of a file, see linux/fiemap.h
+const fsIocFiemap = 0xC020660B
+
+// fiemap is the request for the first extent of a file
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	_             uint32
+	Extent        fiemapExtent
+}
+
+type fiemapExtent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	_        [2]uint64
+	Flags    uint32
+	_        [3]uint32
+}
+
+// readDirectoryInodes returns the names and inode numbers of the entries in the given directory without reading the
+// inodes themselves
+func readDirectoryInodes(dir string) ([]string, []uint64, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer LogError(file.Close)
+
+	names := []string{}
+	inodes := []uint64{}
+	nameOffset := int(unsafe.Offsetof(unix.Dirent{}.Name))
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := unix.Getdents(int(file.Fd()), buffer)
+		if err != nil {
+			return nil, nil, &os.PathError{Op: "getdents", Path: dir, Err: err}
+		} else if n <= 0 {
+			break
+		}
+
+		for offset := 0; offset < n; {
+			dirent := (*unix.Dirent)(unsafe.Pointer(&buffer[offset]))
+			name := buffer[offset+nameOffset : offset+int(dirent.Reclen)]
+			if end := bytes.IndexByte(name, 0); end >= 0 {
+				name = name[:end]
+			}
+			offset += int(dirent.Reclen)
+
+			if dirent.Ino == 0 || string(name) == "." || string(name) == ".." {
+				continue
+			}
+			names = append(names, string(name))
+			inodes = append(inodes, dirent.Ino)
+		}
+	}
+
+	return names, inodes, nil
+}
+
+// fileExtentOffset returns the physical location of the first data block of the given file. Files without data
+// blocks are located at 0.
+func fileExtentOffset(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer LogError(file.Close)
+
+	request := fiemap{
+		Length:      ^uint64(0),
+		ExtentCount: 1,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&request)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	if request.MappedExtents == 0 {
+		return 0, nil
+	}
+	return request.Extent.Physical, nil
+}
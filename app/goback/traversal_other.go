@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// readDirectoryInodes returns the names and inode numbers of the entries in the given directory
+func readDirectoryInodes(dir string) ([]string, []uint64, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer LogError(file.Close)
+
+	files, err := file.Readdir(-1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, len(files))
+	inodes := make([]uint64, len(files))
+	for i, info := range files {
+		names[i] = info.Name()
+		inodes[i], _ = fileInode(info)
+	}
+
+	return names, inodes, nil
+}
+
+// fileExtentOffset is only supported on Linux
+func fileExtentOffset(path string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+)
+
+// WorkersDefault is the number of files or directories processed at the same time
+const WorkersDefault = 1
+
+// workFunction processes the item with the given index. Messages are logged into the given buffer.
+type workFunction func(index int, log *LogBuffer) *Exit
+
+// job is a piece of work queued by a producer. Messages are logged into the given buffer.
+type job func(log *LogBuffer) *Exit
+
+// queueFunction adds a job to the queue. The optional commit function is called after the job succeeded, in the order
+// the jobs were queued. Returns false if no more jobs are accepted because of an error.
+type queueFunction func(work job, commit func() *Exit) bool
+
+// runWorkers calls the given function for the indices 0 to count-1 using the given number of workers. The log output
+// and progress are written in the order of the indices, independent of the order in which the work is done. Stops at
+// the first error and returns it.
+func runWorkers(workers, count int, work workFunction) *Exit {
+	return runJobs(workers, func(queue queueFunction) *Exit {
+		for index := 0; index < count; index++ {
+			index := index
+			if !queue(func(log *LogBuffer) *Exit { return work(index, log) }, nil) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// runJobs runs the jobs added by the producer using the given number of workers. The log output and progress are
+// written in the order in which the jobs were queued. Stops at the first error of a job or the producer and returns it.
+func runJobs(workers int, producer func(queue queueFunction) *Exit) *Exit {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type queued struct {
+		index  int
+		work   job
+		commit func() *Exit
+	}
+
+	type result struct {
+		index  int
+		log    *LogBuffer
+		exit   *Exit
+		commit func() *Exit
+	}
+
+	// A job takes a slot of the window until its output is written, which keeps the producer and the workers from
+	// running too far ahead of a slow job and bounds the results waiting for it
+	window := make(chan struct{}, 2*workers)
+	jobs := make(chan queued, workers)
+	results := make(chan result, workers)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				log := &LogBuffer{}
+				exit := j.work(log)
+				results <- result{j.index, log, exit, j.commit}
+			}
+		}()
+	}
+
+	var producerExit *Exit
+	go func() {
+		defer close(jobs)
+		count := 0
+		producerExit = producer(func(work job, commit func() *Exit) bool {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return false
+			}
+			select {
+			case jobs <- queued{count, work, commit}:
+				count++
+				return true
+			case <-stop:
+				return false
+			}
+		})
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Write results in the order they were queued
+	var exit *Exit
+	pending := make(map[int]result, workers)
+	next := 0
+	for r := range results {
+		pending[r.index] = r
+		for {
+			current, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+
+			if exit != nil {
+				continue
+			}
+
+			current.log.Flush(&Log)
+			Log.Step()
+			if current.exit == nil && current.commit != nil {
+				current.exit = current.commit()
+			}
+			if current.exit != nil {
+				exit = current.exit
+				close(stop)
+			}
+		}
+	}
+
+	// The results are closed after the jobs, which are closed after the producer returned
+	if exit == nil {
+		exit = producerExit
+	}
+
+	return exit
+}
@@ -4,6 +4,10 @@ go 1.14
 
 require (
 	github.com/kisielk/errcheck v1.2.0 // indirect
+	github.com/pkg/sftp v1.12.0
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
 	golang.org/x/tools v0.0.0-20200413015812-1f08ef6002a8 // indirect
 	honnef.co/go/tools v0.0.1-2020.1.3 // indirect
 )